@@ -0,0 +1,594 @@
+package gcm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// CampaignProgress is how far a campaign has come. It is saved to the
+// campaign's ProgressStore after every chunk.
+type CampaignProgress struct {
+	// Sent is the number of registration IDs that have been processed,
+	// counted from the start of the recipient list or source.
+	Sent int `json:"sent"`
+
+	// Success, Failure and CanonicalIDs add up the corresponding fields
+	// of the responses of all chunks sent so far.
+	Success      int `json:"success"`
+	Failure      int `json:"failure"`
+	CanonicalIDs int `json:"canonical_ids"`
+
+	// Suppressed is the number of registration IDs the campaign's
+	// FrequencyCap did not allow to be sent to. They are included in
+	// Sent but not in Success or Failure.
+	Suppressed int `json:"suppressed,omitempty"`
+
+	// Variants breaks the progress down by variant name for campaigns
+	// with Variants. Their own Variants field is always nil.
+	Variants map[string]CampaignProgress `json:"variants,omitempty"`
+}
+
+// add accounts for a response to n registration IDs.
+func (p *CampaignProgress) add(n int, resp *Response) {
+	p.Sent += n
+	p.Success += resp.Success
+	p.Failure += resp.Failure
+	p.CanonicalIDs += resp.CanonicalIDs
+}
+
+// Variant is one arm of an A/B split campaign.
+type Variant struct {
+	// Name identifies the variant in progress reports and callbacks.
+	Name string
+
+	// Weight is the variant's share of the audience relative to the
+	// weights of the other variants.
+	Weight int
+
+	// Message is the message sent to the variant's recipients. Its
+	// RegistrationIDs are ignored.
+	Message *Message
+}
+
+// ProgressStore persists the progress of campaigns, so that a campaign
+// that was interrupted can be resumed by a different process.
+type ProgressStore interface {
+	// Load returns the saved progress of the campaign with the given
+	// ID, or the zero CampaignProgress if there is none.
+	Load(id string) (CampaignProgress, error)
+
+	// Save saves the progress of the campaign with the given ID.
+	Save(id string, p CampaignProgress) error
+}
+
+// MemoryProgressStore is a ProgressStore that keeps progress in memory.
+// It allows pausing and resuming campaigns within a single process. The
+// zero value is ready to use.
+type MemoryProgressStore struct {
+	mu       sync.Mutex
+	progress map[string]CampaignProgress
+}
+
+// Load implements ProgressStore.
+func (m *MemoryProgressStore) Load(id string) (CampaignProgress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.progress[id], nil
+}
+
+// Save implements ProgressStore.
+func (m *MemoryProgressStore) Save(id string, p CampaignProgress) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.progress == nil {
+		m.progress = make(map[string]CampaignProgress)
+	}
+	m.progress[id] = p
+	return nil
+}
+
+// Campaign sends one message to a recipient list that may be far larger
+// than the 1000 registration IDs a single message allows. The list is sent
+// in chunks, each with its own retries, optionally paced, and the progress
+// is saved after every chunk.
+//
+// A campaign is paused by canceling the context passed to Run, and resumed
+// by calling Run again, possibly in another process sharing the same
+// ProgressStore. It then continues with the first chunk that was not
+// completed instead of sending to everyone again.
+type Campaign struct {
+	// ID identifies the campaign in the ProgressStore.
+	ID string
+
+	// Sender sends the chunks.
+	Sender *Sender
+
+	// Message is the message to send. Its RegistrationIDs are ignored.
+	// It is ignored if Variants is set.
+	Message *Message
+
+	// Variants splits the audience into weighted arms that receive
+	// different messages, e.g. for an experiment. Every registration ID
+	// is assigned to a variant by a hash of the campaign ID and the
+	// registration ID, so the assignment is stable across runs and can
+	// be reproduced with AssignVariant.
+	//
+	// A chunk is sent as one request per variant. If a chunk fails after
+	// some of its variants have been sent, those are skipped when Run is
+	// called again on the same Campaign, but are sent a second time if
+	// the campaign is resumed by a new Campaign value.
+	Variants []Variant
+
+	// RegistrationIDs is the recipient list. It is ignored if Source is
+	// set. It must not change between runs of the same campaign.
+	RegistrationIDs []string
+
+	// Source yields the recipients, for audiences too large for
+	// RegistrationIDs. It is read only as far as needed for the next
+	// chunk. When a campaign is resumed by a new Campaign value, the
+	// source must yield the same registration IDs in the same order; the
+	// ones that were already processed are skipped.
+	Source RecipientSource
+
+	// ChunkSize is the number of registration IDs sent per request. If
+	// zero, or greater than 1000, 1000 is used.
+	ChunkSize int
+
+	// Retries is passed to Sender.SendCompiledContext for every chunk. The
+	// RetryPolicy of the message or variant, if any, takes precedence.
+	Retries int
+
+	// Interval is the minimum time between the start of two chunks.
+	Interval time.Duration
+
+	// Clock, if not nil, is used instead of the system clock to pace
+	// the chunks according to Interval and Window, to throttle
+	// OnProgress, and for the timestamps of the report.
+	Clock Clock
+
+	// Window, if not zero, spreads the recipients that have not been
+	// processed yet evenly over that much time, e.g. 2M devices over 30
+	// minutes, so that devices do not all wake up and call the
+	// application server at once. Chunks are made no larger than the
+	// resulting per-second budget and each starts when its share of the
+	// window is due. Window applies to every call to Run anew.
+	Window time.Duration
+
+	// Total is the number of recipients of Source, which pacing over a
+	// Window needs to know in advance. It defaults to the length of
+	// RegistrationIDs.
+	Total int
+
+	// FrequencyCap, if not nil, filters the recipients of every chunk,
+	// counting the campaign's message as a notification of Category.
+	// Recipients the message could not be delivered to are not counted.
+	FrequencyCap *FrequencyCap
+	Category     string
+
+	// OnProgress, if not nil, is called with the number of processed and
+	// failed recipients and the number still remaining, or -1 if that is
+	// unknown because Source is used without Total. It is called after a
+	// chunk once ProgressInterval has passed since the previous call,
+	// after every chunk if ProgressInterval is zero, and when the campaign
+	// completes unless the last chunk has just been reported.
+	OnProgress       func(sent, failed, remaining int)
+	ProgressInterval time.Duration
+
+	// Progress stores the campaign's progress. If nil, it is kept in
+	// memory for the lifetime of the Campaign.
+	Progress ProgressStore
+
+	// OnChunk, if not nil, is called with the variant name, the
+	// registration IDs and the response of every request, e.g. to write
+	// them to an OutcomeWriter. The variant name is empty for campaigns
+	// without Variants.
+	OnChunk func(variant string, regIDs []string, resp *Response)
+
+	// Report, if not nil, receives a CampaignReport in JSON at the end
+	// of every call to Run, whether the run completed or not.
+	Report io.Writer
+
+	memory MemoryProgressStore
+
+	// source is the Source, or RegistrationIDs wrapped in a SliceSource.
+	// consumed counts the registration IDs read from it, and pending
+	// holds the ones read for a chunk that has not been sent yet.
+	source   RecipientSource
+	consumed int
+	pending  []string
+
+	// sentVariants holds the variants of the pending chunk that have
+	// already been sent.
+	sentVariants map[string]bool
+}
+
+// Run sends the campaign's message to every recipient that has not been
+// processed yet and returns the overall progress. ctx is passed on to the
+// Sender, so a tenant set with WithTenant applies to every chunk. If ctx
+// is canceled, Run gives up on the current chunk and returns ctx.Err()
+// together with the progress made so far. If a chunk fails as a whole,
+// the error is returned and the chunk is sent again by the next call to
+// Run. If the chunk was sent but one of the Sender's processors failed,
+// the chunk is accounted for and the ProcessorError is returned, so that
+// the next call to Run continues with the following chunk.
+func (c *Campaign) Run(ctx context.Context) (CampaignProgress, error) {
+	if c.Report == nil {
+		return c.run(ctx, nil)
+	}
+
+	started := now(c.Clock)
+	errs := make(map[ErrorCode]int)
+	progress, err := c.run(ctx, errs)
+	if rerr := c.writeReport(progress, errs, started, err); rerr != nil && err == nil {
+		err = rerr
+	}
+	return progress, err
+}
+
+// run implements Run, counting failed results by error code in errs if it
+// is not nil.
+func (c *Campaign) run(ctx context.Context, errs map[ErrorCode]int) (CampaignProgress, error) {
+	if err := c.check(); err != nil {
+		return CampaignProgress{}, err
+	}
+	compiled := make(map[string]*CompiledMessage)
+	if len(c.Variants) == 0 {
+		m, err := Compile(c.Message)
+		if err != nil {
+			return CampaignProgress{}, err
+		}
+		compiled[""] = m
+	}
+	for _, v := range c.Variants {
+		m, err := Compile(v.Message)
+		if err != nil {
+			return CampaignProgress{}, fmt.Errorf("variant %q: %s", v.Name, err)
+		}
+		compiled[v.Name] = m
+	}
+
+	store := c.Progress
+	if store == nil {
+		store = &c.memory
+	}
+	progress, err := store.Load(c.ID)
+	if err != nil {
+		return progress, err
+	}
+	variants := make(map[string]CampaignProgress, len(progress.Variants))
+	for name, p := range progress.Variants {
+		variants[name] = p
+	}
+	progress.Variants = variants
+
+	chunkSize := c.chunkSize()
+	pace := c.pacer(progress.Sent)
+	if budget := pace.budget(); budget > 0 && budget < chunkSize {
+		chunkSize = budget
+	}
+	started := progress.Sent
+
+	if c.source == nil {
+		c.source = c.Source
+		if c.source == nil {
+			c.source = SliceSource(c.RegistrationIDs)
+		}
+	}
+
+	var last, reported time.Time
+	reportedSent := -1
+	for {
+		if err := ctx.Err(); err != nil {
+			return progress, err
+		}
+		regIDs, err := c.nextChunk(ctx, progress.Sent, chunkSize)
+		if err != nil {
+			return progress, err
+		} else if len(regIDs) == 0 {
+			if reportedSent != progress.Sent {
+				c.reportProgress(progress)
+			}
+			return progress, nil
+		}
+
+		var wait time.Duration
+		if !last.IsZero() {
+			wait = c.Interval - now(c.Clock).Sub(last)
+		}
+		if w := pace.wait(progress.Sent - started); w > wait {
+			wait = w
+		}
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return progress, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		last = now(c.Clock)
+
+		// sentErr is the first error of a group that was sent nonetheless,
+		// such as a ProcessorError. It is returned once the chunk has been
+		// accounted for, so that the chunk is not sent again.
+		var sentErr error
+		for _, g := range c.split(regIDs) {
+			if c.sentVariants[g.variant] {
+				continue
+			}
+			resp, suppressed, err := c.sendGroup(ctx, g.variant, compiled[g.variant], g.regIDs)
+			if resp == nil {
+				return progress, err
+			} else if err != nil && sentErr == nil {
+				sentErr = err
+			}
+			if errs != nil {
+				for _, result := range resp.Results {
+					if result.Error != "" {
+						errs[result.ErrorCode()]++
+					}
+				}
+			}
+			if c.sentVariants == nil {
+				c.sentVariants = make(map[string]bool)
+			}
+			c.sentVariants[g.variant] = true
+
+			// Sent is only advanced once the whole chunk is done.
+			progress.add(0, resp)
+			progress.Suppressed += suppressed
+			if len(c.Variants) > 0 {
+				p := progress.Variants[g.variant]
+				p.add(len(g.regIDs), resp)
+				p.Suppressed += suppressed
+				progress.Variants[g.variant] = p
+			}
+			if err := store.Save(c.ID, progress); err != nil {
+				return progress, err
+			}
+		}
+		c.pending = nil
+		c.sentVariants = nil
+
+		progress.Sent += len(regIDs)
+		if err := store.Save(c.ID, progress); err != nil {
+			return progress, err
+		}
+		if t := now(c.Clock); t.Sub(reported) >= c.ProgressInterval || sentErr != nil {
+			c.reportProgress(progress)
+			reported, reportedSent = t, progress.Sent
+		}
+		if sentErr != nil {
+			return progress, sentErr
+		}
+	}
+}
+
+// chunkSize returns the number of registration IDs sent per request.
+func (c *Campaign) chunkSize() int {
+	if c.ChunkSize <= 0 || c.ChunkSize > maxRegistrationIDs {
+		return maxRegistrationIDs
+	}
+	return c.ChunkSize
+}
+
+// reportProgress passes progress to the OnProgress callback, if set.
+func (c *Campaign) reportProgress(progress CampaignProgress) {
+	if c.OnProgress == nil {
+		return
+	}
+	remaining := -1
+	if c.Source == nil {
+		remaining = len(c.RegistrationIDs) - progress.Sent
+	} else if c.Total > 0 {
+		remaining = c.Total - progress.Sent
+	}
+	c.OnProgress(progress.Sent, progress.Failure, remaining)
+}
+
+// sendGroup sends the message of a variant to the registration IDs the
+// frequency cap allows and returns the response along with the number of
+// suppressed recipients. Recipients the message could not be delivered to
+// do not count against the frequency cap. If the message was sent but the
+// sender's processors or the frequency cap failed, the response is
+// returned along with the error.
+func (c *Campaign) sendGroup(ctx context.Context, variant string, m *CompiledMessage, regIDs []string) (*Response, int, error) {
+	allowed := regIDs
+	var at time.Time
+	if f := c.FrequencyCap; f != nil {
+		var err error
+		at = now(f.Clock)
+		if allowed, err = f.filter(c.Category, regIDs, at); err != nil {
+			return nil, 0, err
+		}
+	}
+	suppressed := len(regIDs) - len(allowed)
+	if len(allowed) == 0 {
+		return &Response{}, suppressed, nil
+	}
+
+	resp, err := c.Sender.SendCompiledContext(ctx, m, c.Retries, allowed...)
+	if c.FrequencyCap != nil {
+		if ferr := c.FrequencyCap.release(c.Category, undelivered(allowed, resp), at); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	if resp == nil {
+		return nil, 0, err
+	}
+	if c.OnChunk != nil {
+		c.OnChunk(variant, allowed, resp)
+	}
+	return resp, suppressed, err
+}
+
+// undelivered returns the registration IDs of regIDs that the message was
+// not delivered to, given the response of the send, which is nil if the
+// send failed.
+func undelivered(regIDs []string, resp *Response) []string {
+	if resp == nil {
+		return regIDs
+	}
+	var failed []string
+	for i, regID := range regIDs {
+		if i >= len(resp.Results) || resp.Results[i].Error != "" {
+			failed = append(failed, regID)
+		}
+	}
+	return failed
+}
+
+// AssignVariant returns the name of the variant regID belongs to, or the
+// empty string if the campaign has no variants.
+func (c *Campaign) AssignVariant(regID string) string {
+	var total int
+	for _, v := range c.Variants {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return ""
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(c.ID))
+	h.Write([]byte{0})
+	h.Write([]byte(regID))
+	n := int(h.Sum32() % uint32(total))
+	for _, v := range c.Variants {
+		if n < v.Weight {
+			return v.Name
+		}
+		n -= v.Weight
+	}
+	return ""
+}
+
+// variantGroup holds the registration IDs of a chunk assigned to the same
+// variant.
+type variantGroup struct {
+	variant string
+	regIDs  []string
+}
+
+// split groups the registration IDs of a chunk by variant, keeping the
+// order of the campaign's Variants.
+func (c *Campaign) split(regIDs []string) []variantGroup {
+	if len(c.Variants) == 0 {
+		return []variantGroup{{regIDs: regIDs}}
+	}
+
+	byVariant := make(map[string][]string, len(c.Variants))
+	for _, regID := range regIDs {
+		name := c.AssignVariant(regID)
+		byVariant[name] = append(byVariant[name], regID)
+	}
+	groups := make([]variantGroup, 0, len(byVariant))
+	for _, v := range c.Variants {
+		if ids := byVariant[v.Name]; len(ids) > 0 {
+			groups = append(groups, variantGroup{variant: v.Name, regIDs: ids})
+		}
+	}
+	return groups
+}
+
+// pacer returns the pacer for a run that starts after sent recipients
+// have been processed.
+func (c *Campaign) pacer(sent int) *pacer {
+	total := c.Total
+	if total == 0 && c.Source == nil {
+		total = len(c.RegistrationIDs)
+	}
+	return &pacer{start: now(c.Clock), window: c.Window, total: total - sent, clock: c.Clock}
+}
+
+// pacer spreads a number of recipients evenly over a time window.
+type pacer struct {
+	start  time.Time
+	window time.Duration
+	total  int
+	clock  Clock
+}
+
+// budget returns the number of recipients to send per second, or 0 if
+// there is no limit.
+func (p *pacer) budget() int {
+	if p.window <= 0 || p.total <= 0 {
+		return 0
+	}
+	seconds := p.window.Seconds()
+	if seconds < 1 {
+		return 0
+	}
+	return int(math.Ceil(float64(p.total) / seconds))
+}
+
+// wait returns how long to wait before sending more recipients once done
+// of them have been sent.
+func (p *pacer) wait(done int) time.Duration {
+	if p.window <= 0 || p.total <= 0 {
+		return 0
+	}
+	offset := time.Duration(float64(p.window) * float64(done) / float64(p.total))
+	return p.start.Add(offset).Sub(now(p.clock))
+}
+
+// nextChunk returns the registration IDs to send next, given that the
+// first sent ones have already been processed. It returns an empty chunk
+// once the source is exhausted.
+func (c *Campaign) nextChunk(ctx context.Context, sent, size int) ([]string, error) {
+	if len(c.pending) > 0 {
+		return c.pending, nil
+	}
+
+	// Skip the registration IDs a previous run has already processed.
+	for ; c.consumed < sent; c.consumed++ {
+		if _, err := c.source.Next(ctx); err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	for len(c.pending) < size {
+		regID, err := c.source.Next(ctx)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		c.pending = append(c.pending, regID)
+		c.consumed++
+	}
+	return c.pending, nil
+}
+
+// check returns an error if the campaign is not well-formed.
+func (c *Campaign) check() error {
+	if c.Sender == nil {
+		return errors.New("the campaign's Sender must not be nil")
+	} else if c.Message == nil && len(c.Variants) == 0 {
+		return errors.New("the campaign's Message must not be nil")
+	} else if c.Retries < 0 {
+		return errors.New("the campaign's Retries field must not be negative")
+	}
+
+	names := make(map[string]bool, len(c.Variants))
+	for _, v := range c.Variants {
+		if v.Name == "" {
+			return errors.New("the campaign's variants must have a name")
+		} else if names[v.Name] {
+			return fmt.Errorf("the campaign has more than one variant named %q", v.Name)
+		} else if v.Weight <= 0 {
+			return fmt.Errorf("variant %q: the weight must be positive", v.Name)
+		} else if v.Message == nil {
+			return fmt.Errorf("variant %q: the message must not be nil", v.Name)
+		}
+		names[v.Name] = true
+	}
+	return nil
+}
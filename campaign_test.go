@@ -0,0 +1,452 @@
+package gcm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startCampaignServer starts a server that succeeds for every registration
+// ID and fails requests once failAfter requests have been answered.
+func startCampaignServer(t *testing.T, failAfter int) (*httptest.Server, *[][]string) {
+	var requests [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failAfter >= 0 && len(requests) >= failAfter {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Fatalf("failed to decode request: %s", err)
+		}
+		requests = append(requests, msg.RegistrationIDs)
+		resp := &Response{Success: len(msg.RegistrationIDs), Results: make([]Result, len(msg.RegistrationIDs))}
+		for i := range resp.Results {
+			resp.Results[i].MessageID = "id"
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	return server, &requests
+}
+
+func campaignIDs(n int) []string {
+	regIDs := make([]string, n)
+	for i := range regIDs {
+		regIDs[i] = strconv.Itoa(i)
+	}
+	return regIDs
+}
+
+func TestCampaign(t *testing.T) {
+	server, requests := startCampaignServer(t, -1)
+	defer server.Close()
+
+	var chunks int
+	c := &Campaign{
+		ID:              "test",
+		Sender:          &Sender{ApiKey: "test", URL: server.URL},
+		Message:         NewMessage(map[string]interface{}{"key": "value"}),
+		RegistrationIDs: campaignIDs(25),
+		ChunkSize:       10,
+		OnChunk:         func(string, []string, *Response) { chunks++ },
+	}
+	progress, err := c.Run(context.Background())
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if progress.Sent != 25 || progress.Success != 25 || progress.Failure != 0 {
+		t.Fatalf("progress %+v, want 25 sent and succeeded", progress)
+	}
+	if len(*requests) != 3 || chunks != 3 || len((*requests)[2]) != 5 {
+		t.Fatalf("server received %v, want chunks of 10, 10 and 5", *requests)
+	}
+}
+
+func TestCampaignResume(t *testing.T) {
+	server, requests := startCampaignServer(t, 2)
+	store := &MemoryProgressStore{}
+	c := &Campaign{
+		ID:              "test",
+		Sender:          &Sender{ApiKey: "test", URL: server.URL},
+		Message:         NewMessage(nil),
+		RegistrationIDs: campaignIDs(25),
+		ChunkSize:       10,
+		Progress:        store,
+	}
+	progress, err := c.Run(context.Background())
+	server.Close()
+	if err == nil {
+		t.Fatal("expect to be failed")
+	}
+	if progress.Sent != 20 {
+		t.Fatalf("sent %d before failure, want 20", progress.Sent)
+	}
+
+	// Resume with another campaign sharing the progress store.
+	server, requests = startCampaignServer(t, -1)
+	defer server.Close()
+	resumed := &Campaign{
+		ID:              c.ID,
+		Sender:          &Sender{ApiKey: "test", URL: server.URL},
+		Message:         c.Message,
+		RegistrationIDs: c.RegistrationIDs,
+		ChunkSize:       c.ChunkSize,
+		Progress:        store,
+	}
+	if progress, err = resumed.Run(context.Background()); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if progress.Sent != 25 || progress.Success != 25 {
+		t.Fatalf("progress %+v, want 25 sent and succeeded", progress)
+	}
+	if len(*requests) != 1 || (*requests)[0][0] != "20" {
+		t.Fatalf("resumed campaign sent %v, want only the last chunk", *requests)
+	}
+}
+
+func TestCampaignPause(t *testing.T) {
+	server, requests := startCampaignServer(t, -1)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Campaign{
+		ID:              "test",
+		Sender:          &Sender{ApiKey: "test", URL: server.URL},
+		Message:         NewMessage(nil),
+		RegistrationIDs: campaignIDs(25),
+		ChunkSize:       10,
+		OnChunk:         func(string, []string, *Response) { cancel() },
+	}
+	progress, err := c.Run(ctx)
+	if err != context.Canceled || progress.Sent != 10 {
+		t.Fatalf("paused campaign returned %+v, %v", progress, err)
+	}
+
+	c.OnChunk = nil
+	if progress, err = c.Run(context.Background()); err != nil || progress.Sent != 25 {
+		t.Fatalf("resumed campaign returned %+v, %v", progress, err)
+	}
+	if len(*requests) != 3 {
+		t.Fatalf("server received %d requests, want 3", len(*requests))
+	}
+}
+
+func TestCampaignSource(t *testing.T) {
+	server, requests := startCampaignServer(t, -1)
+	defer server.Close()
+
+	c := &Campaign{
+		ID:        "test",
+		Sender:    &Sender{ApiKey: "test", URL: server.URL},
+		Message:   NewMessage(nil),
+		Source:    ReaderSource(strings.NewReader("a\nb\n\n c \nd\ne\n")),
+		ChunkSize: 2,
+	}
+	progress, err := c.Run(context.Background())
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if progress.Sent != 5 || len(*requests) != 3 {
+		t.Fatalf("progress %+v after %d requests, want 5 sent in 3 requests", progress, len(*requests))
+	}
+	if got := fmt.Sprint(*requests); got != "[[a b] [c d] [e]]" {
+		t.Fatalf("server received %s", got)
+	}
+}
+
+func TestChanSource(t *testing.T) {
+	ch := make(chan string, 2)
+	ch <- "a"
+	ch <- "b"
+	close(ch)
+
+	src := ChanSource(ch)
+	for _, want := range []string{"a", "b"} {
+		if got, err := src.Next(context.Background()); err != nil || got != want {
+			t.Fatalf("Next returned %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := src.Next(context.Background()); err != io.EOF {
+		t.Fatalf("Next returned %v, want io.EOF", err)
+	}
+}
+
+func TestCampaignVariants(t *testing.T) {
+	var got []Message
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Fatalf("failed to decode request: %s", err)
+		}
+		got = append(got, msg)
+		resp := &Response{Success: len(msg.RegistrationIDs), Results: make([]Result, len(msg.RegistrationIDs))}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	c := &Campaign{
+		ID:     "experiment",
+		Sender: &Sender{ApiKey: "test", URL: server.URL},
+		Variants: []Variant{
+			{Name: "a", Weight: 1, Message: NewMessage(map[string]interface{}{"arm": "a"})},
+			{Name: "b", Weight: 3, Message: NewMessage(map[string]interface{}{"arm": "b"})},
+		},
+		RegistrationIDs: campaignIDs(400),
+		ChunkSize:       100,
+	}
+	c.OnChunk = func(variant string, regIDs []string, resp *Response) {
+		for _, regID := range regIDs {
+			if v := c.AssignVariant(regID); v != variant {
+				t.Fatalf("%s was sent variant %q, assigned %q", regID, variant, v)
+			}
+		}
+	}
+
+	progress, err := c.Run(context.Background())
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	a, b := progress.Variants["a"], progress.Variants["b"]
+	if progress.Sent != 400 || a.Sent+b.Sent != 400 || progress.Success != 400 {
+		t.Fatalf("progress %+v", progress)
+	}
+	if a.Sent < 60 || a.Sent > 140 {
+		t.Fatalf("variant a was sent to %d of 400 recipients, want about 100", a.Sent)
+	}
+	for _, msg := range got {
+		arm := msg.Data["arm"].(string)
+		for _, regID := range msg.RegistrationIDs {
+			if v := c.AssignVariant(regID); v != arm {
+				t.Fatalf("%s received arm %q, assigned %q", regID, arm, v)
+			}
+		}
+	}
+}
+
+func TestCampaignWindow(t *testing.T) {
+	server, requests := startCampaignServer(t, -1)
+	defer server.Close()
+
+	c := &Campaign{
+		ID:              "test",
+		Sender:          &Sender{ApiKey: "test", URL: server.URL},
+		Message:         NewMessage(nil),
+		RegistrationIDs: campaignIDs(40),
+		Window:          2 * time.Second,
+	}
+	start := time.Now()
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	elapsed := time.Since(start)
+
+	// 40 recipients over 2 seconds is a budget of 20 per second, so the
+	// second chunk of 20 starts after one second.
+	if len(*requests) != 2 || len((*requests)[0]) != 20 {
+		t.Fatalf("server received %v, want 2 chunks of 20", *requests)
+	}
+	if elapsed < 900*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("campaign took %s, want about 1s", elapsed)
+	}
+}
+
+func TestPacer(t *testing.T) {
+	p := &pacer{start: time.Now(), window: 30 * time.Minute, total: 2000000}
+	if got := p.budget(); got != 1112 {
+		t.Fatalf("budget %d, want 1112", got)
+	}
+	if got := p.wait(1000000); got < 14*time.Minute || got > 15*time.Minute {
+		t.Fatalf("wait %s halfway through, want about 15m", got)
+	}
+}
+
+func TestCampaignProgress(t *testing.T) {
+	server, _ := startCampaignServer(t, -1)
+	defer server.Close()
+
+	var reports []string
+	c := &Campaign{
+		ID:              "test",
+		Sender:          &Sender{ApiKey: "test", URL: server.URL},
+		Message:         NewMessage(nil),
+		RegistrationIDs: campaignIDs(25),
+		ChunkSize:       10,
+		OnProgress: func(sent, failed, remaining int) {
+			reports = append(reports, fmt.Sprint(sent, failed, remaining))
+		},
+	}
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if got := fmt.Sprint(reports); got != "[10 0 15 20 0 5 25 0 0]" {
+		t.Fatalf("progress reports %s", got)
+	}
+
+	reports = nil
+	c = &Campaign{
+		ID:               "throttled",
+		Sender:           c.Sender,
+		Message:          c.Message,
+		RegistrationIDs:  c.RegistrationIDs,
+		ChunkSize:        10,
+		OnProgress:       c.OnProgress,
+		ProgressInterval: time.Hour,
+	}
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if got := fmt.Sprint(reports); got != "[10 0 15 25 0 0]" {
+		t.Fatalf("progress reports %s, want the first and the final one", got)
+	}
+}
+
+func TestCampaignReport(t *testing.T) {
+	sim := &Simulator{Result: func(regID string) Result {
+		if strings.HasSuffix(regID, "3") {
+			return Result{Error: "NotRegistered"}
+		}
+		return Result{MessageID: "id"}
+	}}
+	var buf strings.Builder
+	c := &Campaign{
+		ID:              "test",
+		Sender:          &Sender{Simulator: sim},
+		Message:         NewMessage(map[string]interface{}{"key": "value"}),
+		RegistrationIDs: campaignIDs(25),
+		ChunkSize:       10,
+		Retries:         2,
+		Report:          &buf,
+	}
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+
+	var report CampaignReport
+	if err := json.Unmarshal([]byte(buf.String()), &report); err != nil {
+		t.Fatalf("failed to decode report: %s", err)
+	}
+	if report.Version != CampaignReportVersion || report.CampaignID != "test" || !report.Completed {
+		t.Fatalf("report %+v, want a completed report of the campaign", report)
+	}
+	if report.Progress.Sent != 25 || report.Progress.Failure != 3 || report.Errors[ErrorNotRegistered] != 3 {
+		t.Fatalf("report %+v, want 25 sent and 3 NotRegistered", report)
+	}
+	if cfg := report.Config; cfg.ChunkSize != 10 || cfg.Retries != 2 || cfg.Recipients != 25 {
+		t.Fatalf("report config %+v, want the campaign's configuration", cfg)
+	}
+}
+
+func TestCampaignClock(t *testing.T) {
+	server, requests := startCampaignServer(t, -1)
+	defer server.Close()
+
+	// Every reading of the clock advances it by an hour, so the hourly
+	// interval never has to be waited for.
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := start
+	var buf strings.Builder
+	c := &Campaign{
+		ID:              "test",
+		Sender:          &Sender{ApiKey: "test", URL: server.URL},
+		Message:         NewMessage(nil),
+		RegistrationIDs: campaignIDs(30),
+		ChunkSize:       10,
+		Interval:        time.Hour,
+		Report:          &buf,
+		Clock: ClockFunc(func() time.Time {
+			t := clock
+			clock = clock.Add(time.Hour)
+			return t
+		}),
+	}
+	begin := time.Now()
+	if _, err := c.Run(context.Background()); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("campaign took %s, want the interval to pass on the campaign's clock", elapsed)
+	}
+	if len(*requests) != 3 {
+		t.Fatalf("server received %v, want 3 chunks", *requests)
+	}
+
+	var report CampaignReport
+	if err := json.Unmarshal([]byte(buf.String()), &report); err != nil {
+		t.Fatalf("failed to decode report: %s", err)
+	}
+	if !report.StartedAt.Equal(start) || !report.FinishedAt.After(start) {
+		t.Fatalf("report from %s to %s, want the campaign's clock", report.StartedAt, report.FinishedAt)
+	}
+}
+
+func TestCampaignContext(t *testing.T) {
+	server, _ := startCampaignServer(t, -1)
+	defer server.Close()
+
+	var tenants []string
+	sender := &Sender{ApiKey: "test", URL: server.URL}
+	sender.Processors = []ResultProcessor{ResultProcessorFunc(func(ctx context.Context, regIDs []string, resp *Response) error {
+		tenant, _ := TenantFromContext(ctx)
+		tenants = append(tenants, tenant)
+		return nil
+	})}
+	c := &Campaign{
+		ID:              "test",
+		Sender:          sender,
+		Message:         NewMessage(nil),
+		RegistrationIDs: campaignIDs(20),
+		ChunkSize:       10,
+	}
+	if _, err := c.Run(WithTenant(context.Background(), "shop")); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if len(tenants) != 2 || tenants[0] != "shop" || tenants[1] != "shop" {
+		t.Fatalf("processors saw tenants %q, want the campaign's", tenants)
+	}
+	if stats := sender.Stats(); stats.Tenants["shop"].Requests != 2 {
+		t.Fatalf("stats %+v, want 2 requests of the tenant", stats.Tenants)
+	}
+}
+
+func TestCampaignProcessorError(t *testing.T) {
+	server, requests := startCampaignServer(t, -1)
+	defer server.Close()
+
+	failed := false
+	sender := &Sender{ApiKey: "test", URL: server.URL}
+	sender.Processors = []ResultProcessor{ResultProcessorFunc(func(ctx context.Context, regIDs []string, resp *Response) error {
+		if failed {
+			return nil
+		}
+		failed = true
+		return errors.New("processor failed")
+	})}
+	c := &Campaign{
+		ID:              "test",
+		Sender:          sender,
+		Message:         NewMessage(nil),
+		RegistrationIDs: campaignIDs(20),
+		ChunkSize:       10,
+		FrequencyCap:    &FrequencyCap{Limit: 1, Window: time.Hour},
+		Category:        "news",
+	}
+	progress, err := c.Run(context.Background())
+	if _, ok := err.(*ProcessorError); !ok || progress.Sent != 10 || progress.Success != 10 {
+		t.Fatalf("campaign returned %+v, %v, want the first chunk accounted for and a ProcessorError", progress, err)
+	}
+
+	if progress, err = c.Run(context.Background()); err != nil || progress.Sent != 20 || progress.Success != 20 || progress.Suppressed != 0 {
+		t.Fatalf("resumed campaign returned %+v, %v", progress, err)
+	}
+	if len(*requests) != 2 || (*requests)[0][0] != "0" || (*requests)[1][0] != "10" {
+		t.Fatalf("server received %v, want every chunk once", *requests)
+	}
+}
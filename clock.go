@@ -0,0 +1,28 @@
+package gcm
+
+import "time"
+
+// Clock tells the current time. The Sender, Campaign, FrequencyCap and
+// HMACSigner take the time from a Clock when it decides an outcome, such
+// as whether a message has expired, a user is over the limit or a chunk
+// is due, so that pipelines can be replayed and simulated
+// deterministically. Latencies are always measured with the system clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts an ordinary function to a Clock.
+type ClockFunc func() time.Time
+
+// Now calls f().
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// now returns the time of c, or of the system clock if c is nil.
+func now(c Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
@@ -0,0 +1,114 @@
+package gcm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// registrationIDsPrefix is how every encoded message starts when its
+// RegistrationIDs field is nil, since it is the first field of Message.
+var registrationIDsPrefix = []byte(`{"registration_ids":null`)
+
+// CompiledMessage is a message that has been validated and encoded ahead
+// of time, except for the registration IDs it is addressed to. Services
+// that fan the same payload out to many devices, possibly through several
+// Senders, can compile it once and pass it to Sender.SendCompiled with
+// each list of registration IDs, skipping repeated validation and
+// encoding of the payload.
+//
+// A CompiledMessage is immutable and safe for concurrent use.
+type CompiledMessage struct {
+	// payload holds the encoded message without its opening brace,
+	// registration IDs and TimeToLive, e.g. `,"data":{"score":"5x1"}}`.
+	payload []byte
+
+	// ttl and enqueuedAt are the message's TimeToLive and EnqueuedAt.
+	// The TimeToLive is encoded for every attempt since it may shrink
+	// between retries.
+	ttl        int
+	enqueuedAt time.Time
+
+	// zeroTTL is the message's ZeroTimeToLive.
+	zeroTTL bool
+
+	// retry is a copy of the message's RetryPolicy.
+	retry *RetryPolicy
+}
+
+// Compile validates every field of msg except its registration IDs and
+// returns the compiled message. Later changes to msg do not affect the
+// compiled message.
+func Compile(msg *Message) (*CompiledMessage, error) {
+	if msg == nil {
+		return nil, errors.New("the message must not be nil")
+	} else if err := checkPayload(msg); err != nil {
+		return nil, err
+	}
+	return compile(msg)
+}
+
+// compile encodes msg without validating it.
+func compile(msg *Message) (*CompiledMessage, error) {
+	m := *msg
+	m.RegistrationIDs = nil
+	m.TimeToLive = 0
+	b, err := json.Marshal(&m)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, registrationIDsPrefix) {
+		return nil, fmt.Errorf("unexpected message encoding %q", b)
+	}
+	c := &CompiledMessage{
+		payload:    b[len(registrationIDsPrefix):],
+		ttl:        msg.TimeToLive,
+		enqueuedAt: msg.EnqueuedAt,
+		zeroTTL:    msg.ZeroTimeToLive,
+	}
+	if msg.RetryPolicy != nil {
+		retry := *msg.RetryPolicy
+		c.retry = &retry
+	}
+	return c, nil
+}
+
+// retries returns the number of retries to use for the message instead of
+// n, which is the RetryPolicy's if the message has one.
+func (c *CompiledMessage) retries(n int) int {
+	if c.retry != nil {
+		return c.retry.Retries
+	}
+	return n
+}
+
+// timeToLive returns the TimeToLive to send at time now, and false if the
+// message has already expired. An EnqueuedAt later than now, due to clock
+// skew between producer and sender, never extends the TimeToLive.
+func (c *CompiledMessage) timeToLive(now time.Time) (int, bool) {
+	if c.ttl == 0 || c.enqueuedAt.IsZero() {
+		return c.ttl, true
+	}
+	ttl := min(c.ttl, c.ttl-int(now.Sub(c.enqueuedAt)/time.Second))
+	return ttl, ttl > 0
+}
+
+// body returns the request body for sending the message to regIDs with
+// the given TimeToLive.
+func (c *CompiledMessage) body(regIDs []string, ttl int) ([]byte, error) {
+	ids, err := json.Marshal(regIDs)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(registrationIDsPrefix)+len(ids)+len(c.payload)+32)
+	b = append(b, `{"registration_ids":`...)
+	b = append(b, ids...)
+	if ttl != 0 || c.zeroTTL {
+		b = append(b, `,"time_to_live":`...)
+		b = strconv.AppendInt(b, int64(ttl), 10)
+	}
+	return append(b, c.payload...), nil
+}
@@ -0,0 +1,151 @@
+package gcm
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompiledMessageBody(t *testing.T) {
+	cases := []*Message{
+		{},
+		{Data: map[string]interface{}{"score": "5x1"}, Priority: PriorityHigh, TimeToLive: 60},
+		{CollapseKey: "key", DryRun: true},
+	}
+
+	for i, msg := range cases {
+		c, err := Compile(msg)
+		if err != nil {
+			t.Fatalf("#%d failed to compile: %s", i, err)
+		}
+
+		regIDs := []string{"1", "2"}
+		body, err := c.body(regIDs, msg.TimeToLive)
+		if err != nil {
+			t.Fatalf("#%d failed to encode: %s", i, err)
+		}
+
+		m := *msg
+		m.RegistrationIDs = regIDs
+		want, _ := json.Marshal(&m)
+		var got, expected interface{}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("#%d invalid body %s: %s", i, body, err)
+		}
+		json.Unmarshal(want, &expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("#%d body %s, want %s", i, body, want)
+		}
+	}
+}
+
+func TestCompileInvalidMessage(t *testing.T) {
+	if _, err := Compile(nil); err == nil {
+		t.Fatal("test should fail when message is nil")
+	}
+	if _, err := Compile(&Message{TimeToLive: -1}); err == nil {
+		t.Fatal("test should fail when message TimeToLive field is negative")
+	}
+	if _, err := Compile(&Message{TimeToLive: 60, ZeroTimeToLive: true}); err == nil {
+		t.Fatal("test should fail when ZeroTimeToLive is set along with a TimeToLive")
+	}
+}
+
+func TestCompiledMessageZeroTimeToLive(t *testing.T) {
+	cases := []struct {
+		msg  *Message
+		want interface{}
+	}{
+		{&Message{}, nil},
+		{&Message{ZeroTimeToLive: true}, 0.0},
+		{ProfileMarketing.apply(&Message{ZeroTimeToLive: true}), 0.0},
+	}
+
+	for i, tc := range cases {
+		c, err := Compile(tc.msg)
+		if err != nil {
+			t.Fatalf("#%d failed to compile: %s", i, err)
+		}
+		ttl, _ := c.timeToLive(time.Now())
+		body, _ := c.body([]string{"1"}, ttl)
+		var got map[string]interface{}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("#%d invalid body %s: %s", i, body, err)
+		}
+		if got["time_to_live"] != tc.want {
+			t.Fatalf("#%d body %s, want time_to_live %v", i, body, tc.want)
+		}
+	}
+}
+
+func TestSendCompiled(t *testing.T) {
+	server := startTestServer(t, []*testResponse{
+		{Response: &Response{Success: 1, Results: []Result{{MessageID: "id"}}}},
+	})
+	defer server.Close()
+
+	c, err := Compile(NewMessage(map[string]interface{}{"key": "value"}))
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	sender := &Sender{ApiKey: "test"}
+	if _, err := sender.SendCompiled(c, 0); err == nil {
+		t.Fatal("test should fail when no registration IDs are specified")
+	}
+
+	resp, err := sender.SendCompiled(c, 0, "1")
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if resp.Success != 1 {
+		t.Fatalf("number of success %d, want 1", resp.Success)
+	}
+}
+
+func TestCompiledMessageTimeToLive(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		msg *Message
+		ttl int
+		ok  bool
+	}{
+		{&Message{}, 0, true},
+		{&Message{TimeToLive: 60}, 60, true},
+		{&Message{TimeToLive: 60, EnqueuedAt: now.Add(-10 * time.Second)}, 50, true},
+		{&Message{TimeToLive: 60, EnqueuedAt: now.Add(-time.Minute)}, 0, false},
+		{&Message{TimeToLive: maxTimeToLive, EnqueuedAt: now.Add(30 * time.Second)}, maxTimeToLive, true},
+	}
+
+	for i, tc := range cases {
+		c, err := Compile(tc.msg)
+		if err != nil {
+			t.Fatalf("#%d failed to compile: %s", i, err)
+		}
+		ttl, ok := c.timeToLive(now)
+		if ok != tc.ok || ok && ttl != tc.ttl {
+			t.Fatalf("#%d timeToLive (%d, %v), want (%d, %v)", i, ttl, ok, tc.ttl, tc.ok)
+		}
+	}
+}
+
+func TestSendExpiredMessage(t *testing.T) {
+	server := startTestServer(t, []*testResponse{})
+	defer server.Close()
+
+	msg := NewMessage(nil, "1")
+	msg.TimeToLive = 60
+	msg.EnqueuedAt = time.Now().Add(-time.Hour)
+	sender := &Sender{ApiKey: "test"}
+	if _, err := sender.Send(msg, 1); err == nil {
+		t.Fatal("test should fail when the message has expired")
+	}
+
+	// The sender's clock decides whether the message has expired.
+	msg.EnqueuedAt = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	sender.Clock = ClockFunc(func() time.Time { return msg.EnqueuedAt.Add(2 * time.Minute) })
+	if _, err := sender.Send(msg, 1); err == nil {
+		t.Fatal("test should fail when the message has expired by the sender's clock")
+	}
+}
@@ -0,0 +1,66 @@
+package gcm
+
+import "context"
+
+// contextKey is the type of the keys this package stores in contexts.
+type contextKey int
+
+const (
+	priorityKey contextKey = iota
+	profileKey
+	tenantKey
+)
+
+// WithPriority returns a copy of ctx carrying a message priority, which
+// Sender.SendContext applies to messages that do not set one. It lets
+// middleware that knows how critical a request is decide the priority of
+// the notifications it triggers.
+func WithPriority(ctx context.Context, priority string) context.Context {
+	return context.WithValue(ctx, priorityKey, priority)
+}
+
+// WithProfile returns a copy of ctx carrying a delivery profile, which
+// Sender.SendContext applies to every message sent with it.
+func WithProfile(ctx context.Context, p Profile) context.Context {
+	return context.WithValue(ctx, profileKey, p)
+}
+
+// WithTenant returns a copy of ctx naming the tenant, such as the team or
+// application, that messages sent with it are accounted to. The Sender's
+// Stats break the bytes sent down by tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// PriorityFromContext returns the priority set by WithPriority, if any.
+func PriorityFromContext(ctx context.Context) (string, bool) {
+	priority, ok := ctx.Value(priorityKey).(string)
+	return priority, ok
+}
+
+// ProfileFromContext returns the profile set by WithProfile, if any.
+func ProfileFromContext(ctx context.Context) (Profile, bool) {
+	p, ok := ctx.Value(profileKey).(Profile)
+	return p, ok
+}
+
+// TenantFromContext returns the tenant set by WithTenant, if any.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey).(string)
+	return tenant, ok
+}
+
+// applyContext returns msg with the delivery settings of ctx applied, and
+// the number of retries to use. msg itself is not modified.
+func applyContext(ctx context.Context, msg *Message, retries int) (*Message, int) {
+	if priority, ok := PriorityFromContext(ctx); ok && msg.Priority == "" {
+		m := *msg
+		m.Priority = priority
+		msg = &m
+	}
+	if p, ok := ProfileFromContext(ctx); ok {
+		msg = p.apply(msg)
+		retries = p.Retries
+	}
+	return msg, retries
+}
@@ -0,0 +1,65 @@
+package gcm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendContextSettings(t *testing.T) {
+	var got []Message
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Fatalf("failed to decode request: %s", err)
+		}
+		got = append(got, msg)
+		json.NewEncoder(w).Encode(&Response{Success: 1, Results: []Result{{MessageID: "id"}}})
+	}))
+	defer server.Close()
+
+	sender := &Sender{ApiKey: "test", URL: server.URL}
+	cases := []struct {
+		ctx      context.Context
+		msg      *Message
+		priority string
+		collapse string
+	}{
+		{context.Background(), NewMessage(nil, "1"), "", ""},
+		{WithPriority(context.Background(), PriorityHigh), NewMessage(nil, "1"), PriorityHigh, ""},
+		{WithPriority(context.Background(), PriorityHigh), &Message{RegistrationIDs: []string{"1"}, Priority: PriorityNormal}, PriorityNormal, ""},
+		{WithProfile(context.Background(), ProfileSilent), NewMessage(nil, "1"), PriorityNormal, "silent"},
+	}
+
+	for i, tc := range cases {
+		if _, err := sender.SendContext(tc.ctx, tc.msg, 0); err != nil {
+			t.Fatalf("#%d expect to be success: %s", i, err)
+		}
+		m := got[len(got)-1]
+		if m.Priority != tc.priority || m.CollapseKey != tc.collapse {
+			t.Fatalf("#%d sent priority %q, collapse key %q, want %q, %q",
+				i, m.Priority, m.CollapseKey, tc.priority, tc.collapse)
+		}
+	}
+}
+
+func TestSendContextCanceled(t *testing.T) {
+	server := startTestServer(t, []*testResponse{
+		{Response: &Response{Failure: 1, Results: []Result{{Error: "Unavailable"}}}},
+	})
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	sender := &Sender{ApiKey: "test"}
+	start := time.Now()
+	if _, err := sender.SendContext(ctx, NewMessage(nil, "1"), 5); err != context.DeadlineExceeded {
+		t.Fatalf("SendContext returned %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("SendContext returned after %s, want it to stop backing off", d)
+	}
+}
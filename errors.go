@@ -0,0 +1,106 @@
+package gcm
+
+// ErrorCode is the error string the GCM server reports for a message that
+// could not be processed. The documented values are listed below; any
+// other string returned by the server is kept verbatim, so it is never
+// lost even if this package does not know about it yet. See the
+// documentation for the list of downstream error codes:
+// https://firebase.google.com/docs/cloud-messaging/http-server-ref#error-codes
+type ErrorCode string
+
+const (
+	// ErrorMissingRegistration means the request contained no
+	// registration ID.
+	ErrorMissingRegistration ErrorCode = "MissingRegistration"
+
+	// ErrorInvalidRegistration means the registration ID is malformed.
+	ErrorInvalidRegistration ErrorCode = "InvalidRegistration"
+
+	// ErrorNotRegistered means the registration ID is no longer valid,
+	// for example because the application was uninstalled. It should be
+	// removed from the application server's database.
+	ErrorNotRegistered ErrorCode = "NotRegistered"
+
+	// ErrorInvalidPackageName means the message was addressed to a
+	// registration ID whose package name does not match the
+	// RestrictedPackageName field.
+	ErrorInvalidPackageName ErrorCode = "InvalidPackageName"
+
+	// ErrorMismatchSenderID means the registration ID is tied to a
+	// different sender.
+	ErrorMismatchSenderID ErrorCode = "MismatchSenderId"
+
+	// ErrorInvalidParameters means the request contained invalid
+	// parameters.
+	ErrorInvalidParameters ErrorCode = "InvalidParameters"
+
+	// ErrorMessageTooBig means the total size of the payload exceeds
+	// the server's limit.
+	ErrorMessageTooBig ErrorCode = "MessageTooBig"
+
+	// ErrorInvalidDataKey means the payload data contains a key that is
+	// reserved for internal use.
+	ErrorInvalidDataKey ErrorCode = "InvalidDataKey"
+
+	// ErrorInvalidTTL means the value of the TimeToLive field is out of
+	// range.
+	ErrorInvalidTTL ErrorCode = "InvalidTtl"
+
+	// ErrorUnavailable means the server timed out processing the
+	// message. It should be retried with exponential backoff.
+	ErrorUnavailable ErrorCode = "Unavailable"
+
+	// ErrorInternalServerError means the server hit an error while
+	// processing the message. It may be retried with exponential backoff.
+	ErrorInternalServerError ErrorCode = "InternalServerError"
+
+	// ErrorDeviceMessageRateExceeded means too many messages were sent to
+	// a single device. It may be retried after a longer delay.
+	ErrorDeviceMessageRateExceeded ErrorCode = "DeviceMessageRateExceeded"
+
+	// ErrorTopicsMessageRateExceeded means too many messages were sent to
+	// the subscribers of a topic. It may be retried after a longer delay.
+	ErrorTopicsMessageRateExceeded ErrorCode = "TopicsMessageRateExceeded"
+
+	// ErrorInvalidApnsCredential means the message could not be delivered
+	// to an iOS device because the APNs certificate or key is missing or
+	// has expired.
+	ErrorInvalidApnsCredential ErrorCode = "InvalidApnsCredential"
+)
+
+// ErrorUnknown returns the ErrorCode for an error string that is not one
+// of the documented codes. The raw string is preserved as is; it exists
+// to make code that handles undocumented errors read explicitly.
+func ErrorUnknown(raw string) ErrorCode {
+	return ErrorCode(raw)
+}
+
+// IsKnown reports whether c is one of the documented error codes.
+func (c ErrorCode) IsKnown() bool {
+	return c.IsPermanent() || c.IsRetryable()
+}
+
+// IsRetryable reports whether a message that failed with c may succeed
+// if it is sent again later.
+func (c ErrorCode) IsRetryable() bool {
+	switch c {
+	case ErrorUnavailable, ErrorInternalServerError,
+		ErrorDeviceMessageRateExceeded, ErrorTopicsMessageRateExceeded:
+		return true
+	}
+	return false
+}
+
+// IsPermanent reports whether a message that failed with c will keep
+// failing no matter how often it is retried. Unknown error codes are
+// neither permanent nor retryable.
+func (c ErrorCode) IsPermanent() bool {
+	switch c {
+	case ErrorMissingRegistration, ErrorInvalidRegistration, ErrorNotRegistered,
+		ErrorInvalidPackageName, ErrorMismatchSenderID, ErrorInvalidParameters,
+		ErrorMessageTooBig, ErrorInvalidDataKey, ErrorInvalidTTL,
+		ErrorInvalidApnsCredential:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package gcm
+
+import "testing"
+
+func TestErrorCode(t *testing.T) {
+	cases := []struct {
+		code      ErrorCode
+		known     bool
+		retryable bool
+		permanent bool
+	}{
+		{ErrorUnavailable, true, true, false},
+		{ErrorInternalServerError, true, true, false},
+		{ErrorNotRegistered, true, false, true},
+		{ErrorMismatchSenderID, true, false, true},
+		{ErrorUnknown("SomethingNew"), false, false, false},
+		{"", false, false, false},
+	}
+
+	for i, tc := range cases {
+		if got := tc.code.IsKnown(); got != tc.known {
+			t.Fatalf("#%d %q IsKnown %v, want %v", i, tc.code, got, tc.known)
+		}
+		if got := tc.code.IsRetryable(); got != tc.retryable {
+			t.Fatalf("#%d %q IsRetryable %v, want %v", i, tc.code, got, tc.retryable)
+		}
+		if got := tc.code.IsPermanent(); got != tc.permanent {
+			t.Fatalf("#%d %q IsPermanent %v, want %v", i, tc.code, got, tc.permanent)
+		}
+	}
+
+	if got := (Result{Error: "SomethingNew"}).ErrorCode(); got != "SomethingNew" {
+		t.Fatalf("unknown error code %q was not preserved", got)
+	}
+}
@@ -0,0 +1,130 @@
+package gcm
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Outcome is the result of sending a message to a single registration ID,
+// flattened for reporting.
+type Outcome struct {
+	RegistrationID string    `json:"registration_id"`
+	MulticastID    int64     `json:"multicast_id"`
+	MessageID      string    `json:"message_id,omitempty"`
+	CanonicalID    string    `json:"canonical_id,omitempty"`
+	Error          ErrorCode `json:"error,omitempty"`
+}
+
+// Outcomes pairs every result of resp with the registration ID it belongs
+// to, and with the multicast ID of the attempt that produced the result.
+// regIDs must be the registration IDs the message was sent to, in the
+// order they were sent.
+func Outcomes(regIDs []string, resp *Response) ([]Outcome, error) {
+	if resp == nil {
+		return nil, errors.New("the response must not be nil")
+	} else if len(regIDs) != len(resp.Results) {
+		return nil, errors.New("the number of registration IDs must match the number of results")
+	}
+
+	outcomes := make([]Outcome, len(regIDs))
+	for i, result := range resp.Results {
+		multicastID := result.MulticastID
+		if multicastID == 0 {
+			multicastID = resp.MulticastID
+		}
+		outcomes[i] = Outcome{
+			RegistrationID: regIDs[i],
+			MulticastID:    multicastID,
+			MessageID:      result.MessageID,
+			CanonicalID:    result.RegistrationID,
+			Error:          result.ErrorCode(),
+		}
+	}
+	return outcomes, nil
+}
+
+// OutcomeWriter writes per-registration ID outcomes of one or more
+// responses to a stream, e.g. for a campaign report.
+type OutcomeWriter interface {
+	// Write writes the outcome of every registration ID resp has a
+	// result for. See Outcomes for the meaning of regIDs.
+	Write(regIDs []string, resp *Response) error
+
+	// Flush writes any buffered data to the underlying writer.
+	Flush() error
+}
+
+// csvHeader is the first record written by a CSV OutcomeWriter.
+var csvHeader = []string{"registration_id", "multicast_id", "message_id", "canonical_id", "error"}
+
+type csvOutcomeWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+// NewCSVOutcomeWriter returns an OutcomeWriter that writes a header
+// followed by one CSV record per registration ID.
+func NewCSVOutcomeWriter(w io.Writer) OutcomeWriter {
+	return &csvOutcomeWriter{w: csv.NewWriter(w)}
+}
+
+func (cw *csvOutcomeWriter) Write(regIDs []string, resp *Response) error {
+	outcomes, err := Outcomes(regIDs, resp)
+	if err != nil {
+		return err
+	}
+	if !cw.wroteHeader {
+		if err := cw.w.Write(csvHeader); err != nil {
+			return err
+		}
+		cw.wroteHeader = true
+	}
+	for _, o := range outcomes {
+		record := []string{
+			o.RegistrationID,
+			strconv.FormatInt(o.MulticastID, 10),
+			o.MessageID,
+			o.CanonicalID,
+			string(o.Error),
+		}
+		if err := cw.w.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cw *csvOutcomeWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type jsonlOutcomeWriter struct {
+	enc *json.Encoder
+}
+
+// NewJSONLOutcomeWriter returns an OutcomeWriter that writes one JSON
+// encoded Outcome per line. It does not buffer, so Flush is a no-op.
+func NewJSONLOutcomeWriter(w io.Writer) OutcomeWriter {
+	return &jsonlOutcomeWriter{enc: json.NewEncoder(w)}
+}
+
+func (jw *jsonlOutcomeWriter) Write(regIDs []string, resp *Response) error {
+	outcomes, err := Outcomes(regIDs, resp)
+	if err != nil {
+		return err
+	}
+	for i := range outcomes {
+		if err := jw.enc.Encode(&outcomes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (jw *jsonlOutcomeWriter) Flush() error {
+	return nil
+}
@@ -0,0 +1,92 @@
+package gcm
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var exportResponse = &Response{
+	MulticastID: 42,
+	Success:     2,
+	Failure:     1,
+	Results: []Result{
+		{MessageID: "m1"},
+		{MessageID: "m2", RegistrationID: "c2"},
+		{Error: "NotRegistered"},
+	},
+}
+
+func TestCSVOutcomeWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewCSVOutcomeWriter(&buf)
+	if err := w.Write([]string{"1", "2", "3"}, exportResponse); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := w.Write([]string{"4"}, &Response{MulticastID: 43, Results: []Result{{MessageID: "m4"}}}); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	want := "registration_id,multicast_id,message_id,canonical_id,error\n" +
+		"1,42,m1,,\n" +
+		"2,42,m2,c2,\n" +
+		"3,42,,,NotRegistered\n" +
+		"4,43,m4,,\n"
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestJSONLOutcomeWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewJSONLOutcomeWriter(&buf)
+	if err := w.Write([]string{"1", "2", "3"}, exportResponse); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	want := `{"registration_id":"1","multicast_id":42,"message_id":"m1"}` + "\n" +
+		`{"registration_id":"2","multicast_id":42,"message_id":"m2","canonical_id":"c2"}` + "\n" +
+		`{"registration_id":"3","multicast_id":42,"error":"NotRegistered"}` + "\n"
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	if err := w.Write([]string{"1"}, exportResponse); err == nil {
+		t.Fatal("test should fail when registration IDs do not match results")
+	}
+}
+
+func TestSampledOutcomeWriter(t *testing.T) {
+	regIDs := make([]string, 1000)
+	resp := &Response{Results: make([]Result, len(regIDs))}
+	for i := range regIDs {
+		regIDs[i] = strconv.Itoa(i)
+		resp.Results[i].MessageID = "id"
+		if i%100 == 0 {
+			resp.Results[i] = Result{Error: "NotRegistered"}
+		}
+	}
+
+	var buf bytes.Buffer
+	w := &SampledOutcomeWriter{W: NewJSONLOutcomeWriter(&buf), Rate: 0.1, KeepFailures: true}
+	if err := w.Write(regIDs, resp); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	if w.Success != 990 || w.Failure != 10 {
+		t.Fatalf("success %d, failure %d, want 990, 10", w.Success, w.Failure)
+	}
+	if w.Sampled < 60 || w.Sampled > 160 {
+		t.Fatalf("sampled %d of 1000 outcomes, want about 110", w.Sampled)
+	}
+	if lines := int64(strings.Count(buf.String(), "\n")); lines != w.Sampled {
+		t.Fatalf("wrote %d lines, want %d", lines, w.Sampled)
+	}
+	if n := strings.Count(buf.String(), "NotRegistered"); n != 10 {
+		t.Fatalf("wrote %d failures, want all 10", n)
+	}
+}
@@ -0,0 +1,211 @@
+package gcm
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// FrequencyStore records the notifications sent per key, so that a
+// FrequencyCap can be shared by several processes.
+type FrequencyStore interface {
+	// Record records a notification for key at time now, unless limit
+	// notifications have already been recorded for key in the window
+	// ending at now. It reports whether the notification was recorded.
+	// Checking and recording must happen atomically.
+	Record(key string, now time.Time, window time.Duration, limit int) (bool, error)
+
+	// Forget removes a notification recorded for key at the given time,
+	// e.g. because it could not be delivered after all. Forgetting a
+	// notification that was not recorded is not an error.
+	Forget(key string, at time.Time) error
+}
+
+// minFrequencySweep is the number of keys a MemoryFrequencyStore holds
+// before it first removes the keys whose window has passed.
+const minFrequencySweep = 64
+
+// MemoryFrequencyStore is a FrequencyStore that keeps the send times in
+// memory. The zero value is ready to use.
+type MemoryFrequencyStore struct {
+	mu    sync.Mutex
+	sends map[string]*frequencyEntry
+
+	// sweepAt is the number of keys at which the next sweep happens.
+	sweepAt int
+}
+
+// frequencyEntry holds the send times recorded for a key, oldest first,
+// and when the last of them leaves its window.
+type frequencyEntry struct {
+	times   []time.Time
+	expires time.Time
+}
+
+// Record implements FrequencyStore.
+func (m *MemoryFrequencyStore) Record(key string, now time.Time, window time.Duration, limit int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sends == nil {
+		m.sends = make(map[string]*frequencyEntry)
+	}
+	m.sweep(now)
+
+	e := m.sends[key]
+	if e == nil {
+		e = new(frequencyEntry)
+		m.sends[key] = e
+	}
+
+	// Drop the send times that have left the window.
+	start := now.Add(-window)
+	i := 0
+	for i < len(e.times) && !e.times[i].After(start) {
+		i++
+	}
+	e.times = e.times[i:]
+
+	if len(e.times) >= limit {
+		return false, nil
+	}
+	e.times = append(e.times, now)
+	if expires := now.Add(window); expires.After(e.expires) {
+		e.expires = expires
+	}
+	return true, nil
+}
+
+// Forget implements FrequencyStore.
+func (m *MemoryFrequencyStore) Forget(key string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.sends[key]
+	if e == nil {
+		return nil
+	}
+	for i := len(e.times) - 1; i >= 0; i-- {
+		if e.times[i].Equal(at) {
+			e.times = append(e.times[:i:i], e.times[i+1:]...)
+			break
+		}
+	}
+	if len(e.times) == 0 {
+		delete(m.sends, key)
+	}
+	return nil
+}
+
+// sweep removes the keys whose send times have all left their window once
+// the number of keys has doubled since the last sweep, so that the keys of
+// users who are not notified again do not accumulate.
+func (m *MemoryFrequencyStore) sweep(now time.Time) {
+	if len(m.sends) < m.sweepAt || len(m.sends) < minFrequencySweep {
+		return
+	}
+	for key, e := range m.sends {
+		if !e.expires.After(now) {
+			delete(m.sends, key)
+		}
+	}
+	m.sweepAt = 2 * len(m.sends)
+}
+
+// FrequencyCap limits how many notifications of a category a user
+// receives within a time window. Notifications over the limit are
+// suppressed rather than sent, and reported through OnSuppressed.
+type FrequencyCap struct {
+	// Limit is the number of notifications of a category a user may
+	// receive within Window.
+	Limit  int
+	Window time.Duration
+
+	// Store keeps track of the notifications sent. If nil, they are kept
+	// in memory for the lifetime of the FrequencyCap.
+	Store FrequencyStore
+
+	// UserOf returns the user a registration ID belongs to. If nil, every
+	// registration ID is treated as a user of its own.
+	UserOf func(regID string) string
+
+	// OnSuppressed, if not nil, is called for every registration ID whose
+	// notification was suppressed.
+	OnSuppressed func(regID, user, category string)
+
+	// Clock, if not nil, is used instead of the system clock.
+	Clock Clock
+
+	memory MemoryFrequencyStore
+}
+
+// Allow reports whether user may receive another notification of the
+// given category, and if so, counts it against the limit.
+func (f *FrequencyCap) Allow(user, category string) (bool, error) {
+	return f.allow(user, category, now(f.Clock))
+}
+
+// allow is like Allow, but records the notification at the given time.
+func (f *FrequencyCap) allow(user, category string, at time.Time) (bool, error) {
+	if f.Limit <= 0 || f.Window <= 0 {
+		return false, errors.New("the frequency cap's Limit and Window must be positive")
+	}
+	return f.store().Record(frequencyKey(user, category), at, f.Window, f.Limit)
+}
+
+// Filter returns the registration IDs that may receive a notification of
+// the given category, counting them against the limit, and reports the
+// others through OnSuppressed.
+func (f *FrequencyCap) Filter(category string, regIDs []string) ([]string, error) {
+	return f.filter(category, regIDs, now(f.Clock))
+}
+
+// filter is like Filter, but records the notifications at the given time,
+// so that they can be forgotten again with release.
+func (f *FrequencyCap) filter(category string, regIDs []string, at time.Time) ([]string, error) {
+	allowed := make([]string, 0, len(regIDs))
+	for _, regID := range regIDs {
+		user := f.userOf(regID)
+		ok, err := f.allow(user, category, at)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			allowed = append(allowed, regID)
+		} else if f.OnSuppressed != nil {
+			f.OnSuppressed(regID, user, category)
+		}
+	}
+	return allowed, nil
+}
+
+// release forgets the notifications that filter recorded at the given
+// time for regIDs, so that they no longer count against the limit.
+func (f *FrequencyCap) release(category string, regIDs []string, at time.Time) error {
+	for _, regID := range regIDs {
+		if err := f.store().Forget(frequencyKey(f.userOf(regID), category), at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// store returns the store the notifications are recorded in.
+func (f *FrequencyCap) store() FrequencyStore {
+	if f.Store == nil {
+		return &f.memory
+	}
+	return f.Store
+}
+
+// userOf returns the user regID belongs to.
+func (f *FrequencyCap) userOf(regID string) string {
+	if f.UserOf == nil {
+		return regID
+	}
+	return f.UserOf(regID)
+}
+
+// frequencyKey returns the key the notifications of a category sent to
+// user are recorded under.
+func frequencyKey(user, category string) string {
+	return category + "\x00" + user
+}
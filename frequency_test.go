@@ -0,0 +1,193 @@
+package gcm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryFrequencyStore(t *testing.T) {
+	var store MemoryFrequencyStore
+	now := time.Now()
+	steps := []struct {
+		at   time.Duration
+		want bool
+	}{
+		{0, true},
+		{time.Minute, true},
+		{2 * time.Minute, false},
+		{time.Hour, true},
+		{time.Hour + time.Second, false},
+		{2*time.Hour + time.Second, true},
+	}
+
+	for i, step := range steps {
+		ok, err := store.Record("key", now.Add(step.at), time.Hour, 2)
+		if err != nil {
+			t.Fatalf("#%d failed to record: %s", i, err)
+		}
+		if ok != step.want {
+			t.Fatalf("#%d recorded %v, want %v", i, ok, step.want)
+		}
+	}
+}
+
+func TestFrequencyCapFilter(t *testing.T) {
+	var suppressed []string
+	f := &FrequencyCap{
+		Limit:        1,
+		Window:       time.Hour,
+		UserOf:       func(regID string) string { return regID[:1] },
+		OnSuppressed: func(regID, user, category string) { suppressed = append(suppressed, regID) },
+	}
+
+	allowed, err := f.Filter("news", []string{"a1", "a2", "b1"})
+	if err != nil {
+		t.Fatalf("failed to filter: %s", err)
+	}
+	if len(allowed) != 2 || allowed[0] != "a1" || allowed[1] != "b1" {
+		t.Fatalf("allowed %v, want [a1 b1]", allowed)
+	}
+	if len(suppressed) != 1 || suppressed[0] != "a2" {
+		t.Fatalf("suppressed %v, want [a2]", suppressed)
+	}
+
+	if allowed, _ = f.Filter("sale", []string{"a1"}); len(allowed) != 1 {
+		t.Fatalf("categories must be capped separately, allowed %v", allowed)
+	}
+}
+
+func TestFrequencyCapClock(t *testing.T) {
+	clock := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := &FrequencyCap{Limit: 1, Window: time.Hour, Clock: ClockFunc(func() time.Time { return clock })}
+
+	for i, tc := range []struct {
+		advance time.Duration
+		allowed bool
+	}{
+		{0, true},
+		{59 * time.Minute, false},
+		{time.Minute, true},
+	} {
+		clock = clock.Add(tc.advance)
+		if allowed, _ := f.Allow("user", "news"); allowed != tc.allowed {
+			t.Fatalf("#%d allowed %v, want %v", i, allowed, tc.allowed)
+		}
+	}
+}
+
+func TestCampaignFrequencyCap(t *testing.T) {
+	server, requests := startCampaignServer(t, -1)
+	defer server.Close()
+
+	f := &FrequencyCap{Limit: 1, Window: time.Hour}
+	f.Filter("news", []string{"1", "3"})
+
+	c := &Campaign{
+		ID:              "test",
+		Sender:          &Sender{ApiKey: "test", URL: server.URL},
+		Message:         NewMessage(nil),
+		RegistrationIDs: campaignIDs(5),
+		FrequencyCap:    f,
+		Category:        "news",
+	}
+	progress, err := c.Run(context.Background())
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if progress.Sent != 5 || progress.Success != 3 || progress.Suppressed != 2 {
+		t.Fatalf("progress %+v, want 5 sent, 3 succeeded and 2 suppressed", progress)
+	}
+	if len(*requests) != 1 || len((*requests)[0]) != 3 {
+		t.Fatalf("server received %v", *requests)
+	}
+}
+
+func TestMemoryFrequencyStoreForget(t *testing.T) {
+	var store MemoryFrequencyStore
+	now := time.Now()
+	store.Record("key", now, time.Hour, 1)
+	if err := store.Forget("key", now); err != nil {
+		t.Fatalf("failed to forget: %s", err)
+	}
+	if ok, _ := store.Record("key", now.Add(time.Minute), time.Hour, 1); !ok {
+		t.Fatal("a forgotten notification must not count against the limit")
+	}
+	if err := store.Forget("unknown", now); err != nil {
+		t.Fatalf("failed to forget an unknown key: %s", err)
+	}
+}
+
+func TestMemoryFrequencyStoreSweep(t *testing.T) {
+	var store MemoryFrequencyStore
+	now := time.Now()
+	for i := 0; i < 2*minFrequencySweep; i++ {
+		store.Record(strconv.Itoa(i), now, time.Hour, 1)
+	}
+	store.Record("late", now.Add(2*time.Hour), time.Hour, 1)
+	if len(store.sends) != 1 {
+		t.Fatalf("store holds %d keys, want only the one still in its window", len(store.sends))
+	}
+}
+
+func TestCampaignFrequencyCapFailure(t *testing.T) {
+	var fail bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var msg Message
+		json.NewDecoder(r.Body).Decode(&msg)
+		resp := &Response{}
+		for _, regID := range msg.RegistrationIDs {
+			if regID == "1" {
+				resp.Failure++
+				resp.Results = append(resp.Results, Result{Error: "InternalServerError"})
+			} else {
+				resp.Success++
+				resp.Results = append(resp.Results, Result{MessageID: "id"})
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	f := &FrequencyCap{Limit: 1, Window: time.Hour}
+	run := func(regIDs []string) (CampaignProgress, error) {
+		c := &Campaign{
+			ID:              "test",
+			Sender:          &Sender{ApiKey: "test", URL: server.URL},
+			Message:         NewMessage(nil),
+			RegistrationIDs: regIDs,
+			FrequencyCap:    f,
+			Category:        "news",
+		}
+		return c.Run(context.Background())
+	}
+
+	fail = true
+	if _, err := run([]string{"2"}); err == nil {
+		t.Fatal("test should fail when the server is unavailable")
+	}
+	fail = false
+	progress, err := run(campaignIDs(3))
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if progress.Success != 2 || progress.Failure != 1 || progress.Suppressed != 0 {
+		t.Fatalf("progress %+v, want 2 succeeded, 1 failed and none suppressed", progress)
+	}
+
+	progress, err = run(campaignIDs(3))
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if progress.Failure != 1 || progress.Suppressed != 2 {
+		t.Fatalf("progress %+v, want the failed recipient to be sent to again", progress)
+	}
+}
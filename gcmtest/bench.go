@@ -0,0 +1,131 @@
+package gcmtest
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mercari/gcm"
+)
+
+// Workload is a representative way of sending messages, benchmarked by
+// Benchmark against a Server.
+type Workload struct {
+	Name string
+
+	// Profile configures the server. Its latency is part of every send,
+	// so benchmarks of the client's own overhead should use none.
+	Profile Profile
+
+	// Data is the payload of every message, and Recipients the number
+	// of registration IDs it is sent to. Recipients defaults to 1.
+	Data       map[string]interface{}
+	Recipients int
+
+	// Compiled sends a message compiled once with Sender.SendCompiled
+	// instead of sending it with Sender.Send.
+	Compiled bool
+
+	// Parallelism, if not zero, sends from that many goroutines per
+	// CPU at once, as with testing.B.SetParallelism.
+	Parallelism int
+
+	// Configure, if not nil, is called with the Sender before the
+	// benchmark starts, e.g. to try out transport settings or hooks.
+	Configure func(*gcm.Sender)
+}
+
+// Workloads are the workloads benchmarked by default: a single device, a
+// full multicast, a compiled fan-out, a large payload and concurrent
+// sends. Retries are not exercised, since their backoff would dominate.
+var Workloads = []Workload{
+	{Name: "Single", Data: map[string]interface{}{"score": "5x1"}},
+	{Name: "Multicast", Data: map[string]interface{}{"score": "5x1"}, Recipients: 1000},
+	{Name: "Compiled", Data: map[string]interface{}{"score": "5x1"}, Recipients: 1000, Compiled: true},
+	{Name: "LargePayload", Data: map[string]interface{}{"body": strings.Repeat("x", 3500)}, Recipients: 100},
+	{Name: "Parallel", Data: map[string]interface{}{"score": "5x1"}, Recipients: 100, Parallelism: 4},
+}
+
+// Benchmark runs every workload as a sub-benchmark of b. Downstream users
+// call it from a benchmark of their own to measure the effect of their
+// configuration on their hardware:
+//
+//	func BenchmarkSend(b *testing.B) {
+//		workloads := append([]gcmtest.Workload(nil), gcmtest.Workloads...)
+//		for i := range workloads {
+//			workloads[i].Configure = configureSender
+//		}
+//		gcmtest.Benchmark(b, workloads)
+//	}
+//
+// Besides the time and allocations per send, it reports the sends and
+// the devices reached per second.
+func Benchmark(b *testing.B, workloads []Workload) {
+	for _, w := range workloads {
+		w := w
+		b.Run(w.Name, func(b *testing.B) {
+			BenchmarkWorkload(b, w)
+		})
+	}
+}
+
+// BenchmarkWorkload benchmarks a single workload against a fresh Server.
+func BenchmarkWorkload(b *testing.B, w Workload) {
+	server := NewServer(w.Profile)
+	defer server.Close()
+	server.discard = true
+
+	sender := server.Sender()
+	if w.Configure != nil {
+		w.Configure(sender)
+	}
+
+	recipients := w.Recipients
+	if recipients <= 0 {
+		recipients = 1
+	}
+	regIDs := make([]string, recipients)
+	for i := range regIDs {
+		regIDs[i] = "bench-" + strconv.Itoa(i)
+	}
+	msg := gcm.NewMessage(w.Data, regIDs...)
+	compiled, err := gcm.Compile(msg)
+	if err != nil {
+		b.Fatalf("failed to compile the message: %s", err)
+	}
+
+	send := func() error {
+		if w.Compiled {
+			_, err := sender.SendCompiled(compiled, 0, regIDs...)
+			return err
+		}
+		_, err := sender.Send(msg, 0)
+		return err
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	if w.Parallelism > 0 {
+		b.SetParallelism(w.Parallelism)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := send(); err != nil {
+					b.Errorf("failed to send: %s", err)
+					return
+				}
+			}
+		})
+	} else {
+		for i := 0; i < b.N; i++ {
+			if err := send(); err != nil {
+				b.Fatalf("failed to send: %s", err)
+			}
+		}
+	}
+	b.StopTimer()
+
+	if seconds := b.Elapsed().Seconds(); seconds > 0 {
+		b.ReportMetric(float64(b.N)/seconds, "sends/s")
+		b.ReportMetric(float64(b.N*recipients)/seconds, "devices/s")
+	}
+}
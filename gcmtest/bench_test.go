@@ -0,0 +1,7 @@
+package gcmtest
+
+import "testing"
+
+func BenchmarkWorkloads(b *testing.B) {
+	Benchmark(b, Workloads)
+}
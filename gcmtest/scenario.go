@@ -0,0 +1,83 @@
+package gcmtest
+
+import (
+	"testing"
+
+	"github.com/mercari/gcm"
+)
+
+// Scenario is a scripted end-to-end exchange between a Sender and a
+// Server, together with the outcome it is expected to produce.
+type Scenario struct {
+	Name string
+
+	// Profile and Steps configure the server; see Server.
+	Profile Profile
+	Steps   []Step
+
+	// TokenErrors are registered with Server.SetTokenError.
+	TokenErrors map[string]gcm.ErrorCode
+
+	// Message is sent with the given number of retries.
+	Message *gcm.Message
+	Retries int
+
+	// Configure, if not nil, is called with the Sender before the
+	// message is sent, e.g. to install hooks.
+	Configure func(*gcm.Sender)
+
+	// WantErr reports whether Send is expected to fail. Otherwise the
+	// response must have WantSuccess successes and WantFailure failures,
+	// and the server must have received WantRequests requests.
+	WantErr      bool
+	WantSuccess  int
+	WantFailure  int
+	WantRequests int
+}
+
+// Run plays every scenario against a fresh Server as a subtest of t.
+func Run(t *testing.T, scenarios []Scenario) {
+	for _, sc := range scenarios {
+		sc := sc
+		t.Run(sc.Name, func(t *testing.T) {
+			RunScenario(t, sc)
+		})
+	}
+}
+
+// RunScenario plays a single scenario and reports mismatches with the
+// expected outcome through t.
+func RunScenario(t testing.TB, sc Scenario) {
+	t.Helper()
+
+	server := NewServer(sc.Profile)
+	defer server.Close()
+	server.Script(sc.Steps...)
+	for regID, code := range sc.TokenErrors {
+		server.SetTokenError(regID, code)
+	}
+
+	sender := server.Sender()
+	if sc.Configure != nil {
+		sc.Configure(sender)
+	}
+
+	resp, err := sender.Send(sc.Message, sc.Retries)
+	if sc.WantErr {
+		if err == nil {
+			t.Errorf("Send succeeded, want an error")
+		}
+		return
+	} else if err != nil {
+		t.Errorf("Send failed: %s", err)
+		return
+	}
+
+	if resp.Success != sc.WantSuccess || resp.Failure != sc.WantFailure {
+		t.Errorf("success %d, failure %d, want %d, %d",
+			resp.Success, resp.Failure, sc.WantSuccess, sc.WantFailure)
+	}
+	if n := len(server.Requests()); n != sc.WantRequests {
+		t.Errorf("server received %d requests, want %d", n, sc.WantRequests)
+	}
+}
@@ -0,0 +1,69 @@
+package gcmtest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mercari/gcm"
+)
+
+func TestScenarios(t *testing.T) {
+	Run(t, []Scenario{
+		{
+			Name:         "healthy",
+			Profile:      Healthy,
+			Message:      gcm.NewMessage(nil, "1", "2", "3"),
+			WantSuccess:  3,
+			WantRequests: 1,
+		},
+		{
+			Name:         "uninstalled device is not retried",
+			Profile:      Healthy,
+			TokenErrors:  map[string]gcm.ErrorCode{"2": gcm.ErrorNotRegistered},
+			Message:      gcm.NewMessage(nil, "1", "2"),
+			Retries:      2,
+			WantSuccess:  1,
+			WantFailure:  1,
+			WantRequests: 1,
+		},
+		{
+			Name:    "unavailable device succeeds on retry",
+			Profile: Healthy,
+			Steps: []Step{
+				{Errors: map[string]gcm.ErrorCode{"2": gcm.ErrorUnavailable}},
+			},
+			Message:      gcm.NewMessage(nil, "1", "2"),
+			Retries:      1,
+			WantSuccess:  2,
+			WantRequests: 2,
+		},
+		{
+			Name:    "outage",
+			Profile: Outage,
+			Message: gcm.NewMessage(nil, "1"),
+			WantErr: true,
+		},
+		{
+			Name:    "scripted status code",
+			Profile: Healthy,
+			Steps:   []Step{{StatusCode: http.StatusBadRequest}},
+			Message: gcm.NewMessage(nil, "1"),
+			WantErr: true,
+		},
+	})
+}
+
+func TestServerRecordsRequests(t *testing.T) {
+	server := NewServer(Healthy)
+	defer server.Close()
+
+	msg := gcm.NewMessage(map[string]interface{}{"key": "value"}, "1")
+	if _, err := server.Sender().SendNoRetry(msg); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 1 || requests[0].Data["key"] != "value" {
+		t.Fatalf("server received %+v", requests)
+	}
+}
@@ -0,0 +1,213 @@
+// Package gcmtest provides an in-process GCM server for end-to-end tests
+// of code that sends messages with package gcm. The server speaks the
+// same HTTP protocol as the real one, and can simulate latency, flaky
+// devices and outages so that retries and error handling are exercised
+// without network access or credentials.
+package gcmtest
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mercari/gcm"
+)
+
+// Profile describes how the server behaves for requests that are not
+// covered by a scripted Step.
+type Profile struct {
+	// Latency is added to every response. Jitter adds up to that much
+	// more, chosen at random.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// RequestErrorRate is the fraction of requests answered with 503
+	// Service Unavailable.
+	RequestErrorRate float64
+
+	// UnavailableRate is the fraction of registration IDs whose result
+	// is an Unavailable error in an otherwise successful response.
+	UnavailableRate float64
+}
+
+var (
+	// Healthy answers every request quickly and successfully.
+	Healthy = Profile{Latency: 5 * time.Millisecond, Jitter: 5 * time.Millisecond}
+
+	// Degraded is slow and fails a tenth of the devices with a
+	// recoverable error, like the real server under heavy load.
+	Degraded = Profile{Latency: 50 * time.Millisecond, Jitter: 50 * time.Millisecond, UnavailableRate: 0.1}
+
+	// Outage answers every request with 503 Service Unavailable.
+	Outage = Profile{RequestErrorRate: 1}
+)
+
+// Step scripts the server's answer to a single request.
+type Step struct {
+	// StatusCode, if not 0 or 200, is returned without a body.
+	StatusCode int
+
+	// Delay is how long to wait before answering.
+	Delay time.Duration
+
+	// Errors maps registration IDs to the error reported for them.
+	// Registration IDs that are not listed succeed.
+	Errors map[string]gcm.ErrorCode
+}
+
+// Server is a fake GCM server. Requests are answered by the scripted steps
+// first, in order, and then according to the server's Profile. Tokens
+// registered with SetTokenError fail with their error in either case.
+type Server struct {
+	// URL is the endpoint to send messages to.
+	URL string
+
+	server *httptest.Server
+
+	mu          sync.Mutex
+	profile     Profile
+	script      []Step
+	tokenErrors map[string]gcm.ErrorCode
+	requests    []gcm.Message
+	rand        *rand.Rand
+	multicastID int64
+	messageID   int64
+
+	// discard is set by benchmarks, which must not keep every request.
+	discard bool
+}
+
+// NewServer starts a server that behaves according to p. The caller must
+// call Close when done.
+func NewServer(p Profile) *Server {
+	s := &Server{
+		profile:     p,
+		tokenErrors: make(map[string]gcm.ErrorCode),
+		rand:        rand.New(rand.NewSource(1)),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Sender returns a Sender that sends messages to the server.
+func (s *Server) Sender() *gcm.Sender {
+	return &gcm.Sender{ApiKey: "gcmtest", URL: s.URL, Http: s.server.Client()}
+}
+
+// SetProfile changes how the server answers unscripted requests.
+func (s *Server) SetProfile(p Profile) {
+	s.mu.Lock()
+	s.profile = p
+	s.mu.Unlock()
+}
+
+// Script appends steps that answer the next requests, in order.
+func (s *Server) Script(steps ...Step) {
+	s.mu.Lock()
+	s.script = append(s.script, steps...)
+	s.mu.Unlock()
+}
+
+// SetTokenError makes every message sent to regID fail with code, as when
+// the application has been uninstalled from the device.
+func (s *Server) SetTokenError(regID string, code gcm.ErrorCode) {
+	s.mu.Lock()
+	s.tokenErrors[regID] = code
+	s.mu.Unlock()
+}
+
+// Requests returns the messages the server has received so far.
+func (s *Server) Requests() []gcm.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]gcm.Message(nil), s.requests...)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "HEAD" {
+		return
+	} else if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if !strings.HasPrefix(r.Header.Get("Authorization"), "key=") {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var msg gcm.Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status, delay, resp := s.answer(&msg)
+	time.Sleep(delay)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// answer records msg and decides how to respond to it.
+func (s *Server) answer(msg *gcm.Message) (int, time.Duration, *gcm.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.discard {
+		s.requests = append(s.requests, *msg)
+	}
+
+	var step Step
+	scripted := len(s.script) > 0
+	if scripted {
+		step, s.script = s.script[0], s.script[1:]
+	} else {
+		step.Delay = s.profile.Latency
+		if s.profile.Jitter > 0 {
+			step.Delay += time.Duration(s.rand.Int63n(int64(s.profile.Jitter)))
+		}
+		if s.rand.Float64() < s.profile.RequestErrorRate {
+			step.StatusCode = http.StatusServiceUnavailable
+		}
+	}
+	if step.StatusCode != 0 && step.StatusCode != http.StatusOK {
+		return step.StatusCode, step.Delay, nil
+	}
+
+	s.multicastID++
+	resp := &gcm.Response{
+		MulticastID: s.multicastID,
+		Results:     make([]gcm.Result, len(msg.RegistrationIDs)),
+	}
+	for i, regID := range msg.RegistrationIDs {
+		code, ok := s.tokenErrors[regID]
+		if !ok && scripted {
+			code = step.Errors[regID]
+		} else if !ok && s.rand.Float64() < s.profile.UnavailableRate {
+			code = gcm.ErrorUnavailable
+		}
+
+		if code != "" {
+			resp.Results[i].Error = string(code)
+			resp.Failure++
+			continue
+		}
+		s.messageID++
+		resp.Results[i].MessageID = "0:" + strconv.FormatInt(s.messageID, 10)
+		resp.Success++
+	}
+	return http.StatusOK, step.Delay, resp
+}
@@ -1,5 +1,22 @@
 package gcm
 
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// PriorityNormal is the default priority for data messages. Normal
+	// priority messages may be delayed while the device is dozing.
+	PriorityNormal = "normal"
+
+	// PriorityHigh wakes a sleeping device and opens a network connection
+	// to the application server. Use it only for time-sensitive messages.
+	PriorityHigh = "high"
+)
+
 // Message is used by the application server to send a message to
 // the GCM server. See the documentation for GCM Architectural
 // Overview for more information:
@@ -7,11 +24,54 @@ package gcm
 type Message struct {
 	RegistrationIDs       []string               `json:"registration_ids"`
 	CollapseKey           string                 `json:"collapse_key,omitempty"`
+	Priority              string                 `json:"priority,omitempty"`
+	ContentAvailable      bool                   `json:"content_available,omitempty"`
 	Data                  map[string]interface{} `json:"data,omitempty"`
+	Notification          *Notification          `json:"notification,omitempty"`
 	DelayWhileIdle        bool                   `json:"delay_while_idle,omitempty"`
 	TimeToLive            int                    `json:"time_to_live,omitempty"`
 	RestrictedPackageName string                 `json:"restricted_package_name,omitempty"`
 	DryRun                bool                   `json:"dry_run,omitempty"`
+
+	// EnqueuedAt, if set, is the time the TimeToLive is measured from,
+	// typically when the producer enqueued the message. Each attempt
+	// then sends only the TimeToLive that remains, so the message
+	// expires on the device when the producer intended rather than
+	// restarting the clock on every retry. A message whose TimeToLive
+	// has run out is not sent again.
+	EnqueuedAt time.Time `json:"-"`
+
+	// ZeroTimeToLive makes the Sender send a TimeToLive of 0 instead of
+	// leaving the field out, which makes the message now or never: it
+	// is discarded if the device cannot be reached right away. A
+	// TimeToLive of 0 alone means the field is unset and the server's
+	// default of 4 weeks applies. TimeToLive must be 0 if it is set.
+	ZeroTimeToLive bool `json:"-"`
+
+	// RetryPolicy, if not nil, overrides how the Sender retries the
+	// message. Its Retries take precedence over every other source of
+	// the number of retries: the argument of Send, SendContext,
+	// SendCompiled and SendCompiledContext, the Retries of a profile
+	// passed to SendWithProfile or attached with WithProfile, and the
+	// Retries of a Campaign.
+	// SendNoRetry still sends the message only once.
+	RetryPolicy *RetryPolicy `json:"-"`
+}
+
+// RetryPolicy controls how persistently a Sender retries a message whose
+// delivery failed with a recoverable error, e.g. only briefly for a
+// one-time password that is useless after a minute, but for hours for a
+// marketing message.
+type RetryPolicy struct {
+	// Retries is the maximum number of retries.
+	Retries int
+
+	// InitialBackoff is the delay before the first retry, and
+	// MaxBackoff caps the delay, which doubles with every retry. Each
+	// delay is randomized by up to half of it. If zero, the Sender's
+	// defaults of one second and about 17 minutes are used.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
 }
 
 // NewMessage returns a new Message with the specified payload
@@ -19,3 +79,202 @@ type Message struct {
 func NewMessage(data map[string]interface{}, regIDs ...string) *Message {
 	return &Message{RegistrationIDs: regIDs, Data: data}
 }
+
+// Notification is the user-visible part of a message, which the device
+// displays on the application's behalf. See the documentation for the
+// notification payload for the meaning of the fields:
+// https://firebase.google.com/docs/cloud-messaging/http-server-ref#notification-payload-support
+type Notification struct {
+	Title        string `json:"title,omitempty"`
+	Body         string `json:"body,omitempty"`
+	Icon         string `json:"icon,omitempty"`
+	Sound        string `json:"sound,omitempty"`
+	Badge        string `json:"badge,omitempty"`
+	Tag          string `json:"tag,omitempty"`
+	Color        string `json:"color,omitempty"`
+	ClickAction  string `json:"click_action,omitempty"`
+	BodyLocKey   string `json:"body_loc_key,omitempty"`
+	BodyLocArgs  string `json:"body_loc_args,omitempty"`
+	TitleLocKey  string `json:"title_loc_key,omitempty"`
+	TitleLocArgs string `json:"title_loc_args,omitempty"`
+}
+
+// NewCombinedMessage returns a new Message that carries both a
+// notification and a data payload. Such messages behave differently per
+// platform and application state; on Android, for example, a message
+// received in the background is displayed by the system and its data is
+// only handed to the application if the user taps the notification. Call
+// Pitfalls, or set the Sender's OnWarning hook, to catch the common
+// mistakes.
+func NewCombinedMessage(n *Notification, data map[string]interface{}, regIDs ...string) *Message {
+	return &Message{RegistrationIDs: regIDs, Data: data, Notification: n}
+}
+
+// Pitfalls returns warnings about settings of the message that are valid
+// but likely to behave differently than intended on some platforms. The
+// Sender reports them through its OnWarning hook before sending.
+func (m *Message) Pitfalls() []Warning {
+	var warnings []Warning
+	for key := range m.Data {
+		if isReservedDataKey(key) {
+			warnings = append(warnings, Warning{Code: WarningReservedDataKey, Field: "data." + key, Count: 1})
+		}
+	}
+
+	n := m.Notification
+	if n == nil {
+		return warnings
+	}
+	if n.Title == "" && n.Body == "" && n.TitleLocKey == "" && n.BodyLocKey == "" {
+		warnings = append(warnings, Warning{Code: WarningEmptyNotification, Field: "notification", Count: 1})
+	}
+	if len(m.Data) > 0 && n.ClickAction == "" {
+		warnings = append(warnings, Warning{Code: WarningBackgroundData, Field: "notification.click_action", Count: 1})
+	}
+	if m.ContentAvailable {
+		warnings = append(warnings, Warning{Code: WarningSilentNotification, Field: "content_available", Count: 1})
+	}
+	return warnings
+}
+
+// isReservedDataKey reports whether key may not be used in a data payload.
+func isReservedDataKey(key string) bool {
+	return key == "from" || key == "notification" || key == "message_type" ||
+		strings.HasPrefix(key, "google") || strings.HasPrefix(key, "gcm")
+}
+
+// EstimatedSize returns the size in bytes of the request body the Sender
+// would post for this message. Producers can use it to decide on a
+// cheaper message, such as a tickle without data, before handing the
+// message to the Sender. It returns -1 if the message cannot be encoded.
+func (m *Message) EstimatedSize() int {
+	c, err := compile(m)
+	if err != nil {
+		return -1
+	}
+	b, err := c.body(m.RegistrationIDs, c.ttl)
+	if err != nil {
+		return -1
+	}
+	return len(b)
+}
+
+// payloadSize returns the encoded size in bytes of the data and
+// notification payloads of msg, which the server limits to 4096 bytes.
+func payloadSize(msg *Message) int {
+	var size int
+	if msg.Data != nil {
+		b, _ := json.Marshal(msg.Data)
+		size += len(b)
+	}
+	if msg.Notification != nil {
+		b, _ := json.Marshal(msg.Notification)
+		size += len(b)
+	}
+	return size
+}
+
+// DuplicatePolicy decides how a Sender handles a message that lists the
+// same registration ID more than once. Duplicates waste quota, since the
+// device receives the message once per occurrence, and skew the success
+// counts of the response.
+type DuplicatePolicy int
+
+const (
+	// DuplicatesAllow sends the registration IDs as given.
+	DuplicatesAllow DuplicatePolicy = iota
+
+	// DuplicatesReject fails the send before anything is sent.
+	DuplicatesReject
+
+	// DuplicatesRemove sends to every registration ID once. The
+	// response still has one result per registration ID given, in the
+	// same order, with duplicates sharing the result of their first
+	// occurrence; its Success, Failure and CanonicalIDs count every
+	// device once.
+	DuplicatesRemove
+)
+
+// Profile bundles the delivery settings that usually go together for a
+// class of traffic. Instead of setting priority, TTL, collapse key and the
+// number of retries by hand on every message, pass one of the predefined
+// profiles (or your own) to Sender.SendWithProfile.
+//
+// A profile only fills in the fields that are left at their zero value
+// on the message, so a message can still override individual settings.
+type Profile struct {
+	Name             string
+	Priority         string
+	TimeToLive       int
+	CollapseKey      string
+	DelayWhileIdle   bool
+	ContentAvailable bool
+	Retries          int
+}
+
+var (
+	// ProfileTransactional is meant for messages the user is actively
+	// waiting for, such as one-time passwords or chat messages. They are
+	// delivered with high priority, expire after an hour and are retried
+	// aggressively.
+	ProfileTransactional = Profile{
+		Name:       "transactional",
+		Priority:   PriorityHigh,
+		TimeToLive: 3600,
+		Retries:    5,
+	}
+
+	// ProfileMarketing is meant for promotional messages. They are
+	// delivered with normal priority, may wait until the device is
+	// active, replace any older undelivered campaign message and are
+	// retried only once.
+	ProfileMarketing = Profile{
+		Name:           "marketing",
+		Priority:       PriorityNormal,
+		TimeToLive:     86400,
+		CollapseKey:    "marketing",
+		DelayWhileIdle: true,
+		Retries:        1,
+	}
+
+	// ProfileSilent is meant for background sync tickles that show nothing
+	// to the user. Only the latest tickle is kept and it is not retried,
+	// since the next one will carry the same information.
+	ProfileSilent = Profile{
+		Name:             "silent",
+		Priority:         PriorityNormal,
+		TimeToLive:       3600,
+		CollapseKey:      "silent",
+		ContentAvailable: true,
+	}
+)
+
+// apply returns a shallow copy of msg with every zero-valued field that
+// the profile covers set to the profile's value.
+func (p *Profile) apply(msg *Message) *Message {
+	m := *msg
+	if m.Priority == "" {
+		m.Priority = p.Priority
+	}
+	if m.TimeToLive == 0 && !m.ZeroTimeToLive {
+		m.TimeToLive = p.TimeToLive
+	}
+	if m.CollapseKey == "" {
+		m.CollapseKey = p.CollapseKey
+	}
+	if !m.DelayWhileIdle {
+		m.DelayWhileIdle = p.DelayWhileIdle
+	}
+	if !m.ContentAvailable {
+		m.ContentAvailable = p.ContentAvailable
+	}
+	return &m
+}
+
+// check returns an error if the profile is not well-formed.
+func (p *Profile) check() error {
+	if p.Retries < 0 {
+		return errors.New("the profile's Retries field must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package gcm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEstimatedSize(t *testing.T) {
+	msg := NewMessage(map[string]interface{}{"score": "5x1"}, "1", "2")
+	want, _ := json.Marshal(msg)
+	if got := msg.EstimatedSize(); got != len(want) {
+		t.Fatalf("EstimatedSize %d, want %d", got, len(want))
+	}
+
+	// The estimate matches the body that is posted, including the
+	// TimeToLive of zero that ZeroTimeToLive adds.
+	var posted int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		posted = len(body)
+		json.NewEncoder(w).Encode(&Response{Success: 2, Results: []Result{{MessageID: "a"}, {MessageID: "b"}}})
+	}))
+	defer server.Close()
+	msg.ZeroTimeToLive = true
+	if _, err := (&Sender{ApiKey: "test", URL: server.URL}).SendNoRetry(msg); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if got := msg.EstimatedSize(); got != posted {
+		t.Fatalf("EstimatedSize %d, want the %d bytes posted", got, posted)
+	}
+
+	msg.Data["invalid"] = make(chan int)
+	if got := msg.EstimatedSize(); got != -1 {
+		t.Fatalf("EstimatedSize %d for unencodable message, want -1", got)
+	}
+}
+
+func TestPitfalls(t *testing.T) {
+	cases := []struct {
+		msg  *Message
+		want []WarningCode
+	}{
+		{NewMessage(map[string]interface{}{"key": "value"}), nil},
+		{NewMessage(map[string]interface{}{"from": "me"}), []WarningCode{WarningReservedDataKey}},
+		{NewCombinedMessage(&Notification{Title: "t", ClickAction: "OPEN"}, map[string]interface{}{"key": "value"}), nil},
+		{NewCombinedMessage(&Notification{Title: "t"}, map[string]interface{}{"key": "value"}), []WarningCode{WarningBackgroundData}},
+		{NewCombinedMessage(&Notification{}, nil), []WarningCode{WarningEmptyNotification}},
+		{&Message{Notification: &Notification{Body: "b"}, ContentAvailable: true}, []WarningCode{WarningSilentNotification}},
+	}
+
+	for i, tc := range cases {
+		warnings := tc.msg.Pitfalls()
+		if len(warnings) != len(tc.want) {
+			t.Fatalf("#%d warnings %v, want %v", i, warnings, tc.want)
+		}
+		for j, w := range warnings {
+			if w.Code != tc.want[j] {
+				t.Fatalf("#%d warnings %v, want %v", i, warnings, tc.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package gcm
+
+import (
+	"context"
+	"fmt"
+)
+
+// ResultProcessor handles the results of a message after it was sent,
+// e.g. to remove unregistered tokens, store canonical IDs, or feed
+// analytics and alerting. A Sender runs its Processors in order after
+// every send, including the sends of a Campaign.
+type ResultProcessor interface {
+	// Process handles resp, the final response to a message sent to
+	// regIDs. resp.Results holds one result per registration ID, in
+	// the same order.
+	Process(ctx context.Context, regIDs []string, resp *Response) error
+}
+
+// ResultProcessorFunc adapts an ordinary function to a ResultProcessor.
+type ResultProcessorFunc func(ctx context.Context, regIDs []string, resp *Response) error
+
+// Process calls f(ctx, regIDs, resp).
+func (f ResultProcessorFunc) Process(ctx context.Context, regIDs []string, resp *Response) error {
+	return f(ctx, regIDs, resp)
+}
+
+// ProcessorError is returned by a Sender when one of its Processors
+// failed. The message was sent nonetheless, so the Sender returns the
+// response along with the error. Processors after the failing one are
+// not run.
+type ProcessorError struct {
+	// Index is the position of the failing processor in the Sender's
+	// Processors.
+	Index int
+
+	// Err is the error the processor returned.
+	Err error
+}
+
+func (e *ProcessorError) Error() string {
+	return fmt.Sprintf("result processor #%d failed: %s", e.Index, e.Err)
+}
+
+// Unwrap returns the error the processor returned.
+func (e *ProcessorError) Unwrap() error {
+	return e.Err
+}
+
+// TokenMaintainer is a ResultProcessor for the usual upkeep of a token
+// database: it reports registration IDs that should be deleted and those
+// that were replaced by a canonical ID. Either function may be nil.
+type TokenMaintainer struct {
+	// Remove is called for every registration ID that is unregistered or
+	// invalid, such as one that failed with NotRegistered.
+	Remove func(ctx context.Context, regID string, code ErrorCode) error
+
+	// Replace is called for every registration ID the server returned a
+	// canonical ID for.
+	Replace func(ctx context.Context, regID, canonicalID string) error
+}
+
+// Process implements ResultProcessor.
+func (tm *TokenMaintainer) Process(ctx context.Context, regIDs []string, resp *Response) error {
+	for i, result := range resp.Results {
+		if i >= len(regIDs) {
+			break
+		}
+		if status := tokenStatus(result); status == TokenUnregistered || status == TokenInvalid {
+			if tm.Remove != nil {
+				if err := tm.Remove(ctx, regIDs[i], result.ErrorCode()); err != nil {
+					return err
+				}
+			}
+		} else if result.RegistrationID != "" && tm.Replace != nil {
+			if err := tm.Replace(ctx, regIDs[i], result.RegistrationID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// process runs the sender's processors in order on resp.
+func (s *Sender) process(ctx context.Context, regIDs []string, resp *Response) error {
+	for i, p := range s.Processors {
+		if err := p.Process(ctx, regIDs, resp); err != nil {
+			return &ProcessorError{Index: i, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package gcm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSendProcessors(t *testing.T) {
+	server := startTestServer(t, []*testResponse{
+		{Response: &Response{Success: 2, Failure: 1, CanonicalIDs: 1, Results: []Result{
+			{MessageID: "id1"},
+			{MessageID: "id2", RegistrationID: "new2"},
+			{Error: "NotRegistered"},
+		}}},
+		{Response: &Response{Success: 1, Results: []Result{{MessageID: "id4"}}}},
+	})
+	defer server.Close()
+
+	var calls []string
+	sender, _ := NewClient(server.URL, "testAPIKey")
+	sender.Processors = []ResultProcessor{
+		&TokenMaintainer{
+			Remove: func(ctx context.Context, regID string, code ErrorCode) error {
+				calls = append(calls, fmt.Sprintf("remove %s %s", regID, code))
+				return nil
+			},
+			Replace: func(ctx context.Context, regID, canonicalID string) error {
+				calls = append(calls, fmt.Sprintf("replace %s %s", regID, canonicalID))
+				return nil
+			},
+		},
+		ResultProcessorFunc(func(ctx context.Context, regIDs []string, resp *Response) error {
+			calls = append(calls, fmt.Sprintf("analytics %d", len(regIDs)))
+			return errors.New("unavailable")
+		}),
+		ResultProcessorFunc(func(ctx context.Context, regIDs []string, resp *Response) error {
+			t.Fatal("processor after a failing one should not run")
+			return nil
+		}),
+	}
+
+	resp, err := sender.SendNoRetry(NewMessage(nil, "1", "2", "3"))
+	if resp == nil || resp.Success != 2 {
+		t.Fatalf("response %+v, want the response despite the failing processor", resp)
+	}
+	var perr *ProcessorError
+	if !errors.As(err, &perr) || perr.Index != 1 {
+		t.Fatalf("error %v, want a ProcessorError for processor #1", err)
+	}
+	want := "[replace 2 new2 remove 3 NotRegistered analytics 3]"
+	if got := fmt.Sprint(calls); got != want {
+		t.Fatalf("calls %s, want %s", got, want)
+	}
+
+	calls = nil
+	sender.Processors = sender.Processors[:1]
+	if _, err := sender.SendNoRetry(NewMessage(nil, "4")); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("calls %v, want none for a successful message", calls)
+	}
+}
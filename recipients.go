@@ -0,0 +1,80 @@
+package gcm
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+)
+
+// RecipientSource yields registration IDs one at a time, so that a
+// campaign can be sent to an audience far too large to hold in memory,
+// e.g. by reading from a database cursor or a file.
+type RecipientSource interface {
+	// Next returns the next registration ID. It returns io.EOF when
+	// there are no more registration IDs.
+	Next(ctx context.Context) (string, error)
+}
+
+type sliceSource struct {
+	regIDs []string
+}
+
+// SliceSource returns a RecipientSource yielding the given registration
+// IDs in order.
+func SliceSource(regIDs []string) RecipientSource {
+	return &sliceSource{regIDs: regIDs}
+}
+
+func (s *sliceSource) Next(ctx context.Context) (string, error) {
+	if len(s.regIDs) == 0 {
+		return "", io.EOF
+	}
+	regID := s.regIDs[0]
+	s.regIDs = s.regIDs[1:]
+	return regID, nil
+}
+
+type chanSource struct {
+	ch <-chan string
+}
+
+// ChanSource returns a RecipientSource yielding the registration IDs
+// received from ch until it is closed.
+func ChanSource(ch <-chan string) RecipientSource {
+	return &chanSource{ch: ch}
+}
+
+func (s *chanSource) Next(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case regID, ok := <-s.ch:
+		if !ok {
+			return "", io.EOF
+		}
+		return regID, nil
+	}
+}
+
+type scannerSource struct {
+	scanner *bufio.Scanner
+}
+
+// ReaderSource returns a RecipientSource yielding one registration ID per
+// line of r. Surrounding white space and empty lines are skipped.
+func ReaderSource(r io.Reader) RecipientSource {
+	return &scannerSource{scanner: bufio.NewScanner(r)}
+}
+
+func (s *scannerSource) Next(ctx context.Context) (string, error) {
+	for s.scanner.Scan() {
+		if regID := strings.TrimSpace(s.scanner.Text()); regID != "" {
+			return regID, nil
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", io.EOF
+}
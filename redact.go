@@ -0,0 +1,44 @@
+package gcm
+
+// redacted replaces the values removed by RedactValues.
+const redacted = "[redacted]"
+
+// Redactor returns a copy of msg that is safe to hand to logs, audit
+// sinks and debug dumps. It must not modify msg.
+type Redactor func(msg *Message) *Message
+
+// RedactValues is a Redactor that keeps the structure of a message but
+// not its content: data keys are kept while their values are replaced,
+// the texts of the notification are replaced, and registration IDs are
+// cut to their first 8 characters.
+func RedactValues(msg *Message) *Message {
+	if msg == nil {
+		return nil
+	}
+	m := *msg
+	if msg.RegistrationIDs != nil {
+		m.RegistrationIDs = make([]string, len(msg.RegistrationIDs))
+		for i, regID := range msg.RegistrationIDs {
+			if len(regID) > 8 {
+				regID = regID[:8] + "..."
+			}
+			m.RegistrationIDs[i] = regID
+		}
+	}
+	if msg.Data != nil {
+		m.Data = make(map[string]interface{}, len(msg.Data))
+		for key := range msg.Data {
+			m.Data[key] = redacted
+		}
+	}
+	if msg.Notification != nil {
+		n := *msg.Notification
+		for _, s := range []*string{&n.Title, &n.Body, &n.TitleLocArgs, &n.BodyLocArgs} {
+			if *s != "" {
+				*s = redacted
+			}
+		}
+		m.Notification = &n
+	}
+	return &m
+}
@@ -0,0 +1,93 @@
+package gcm
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// CampaignReportVersion is the version of the CampaignReport format. It
+// is incremented whenever a field is removed or changes meaning; fields
+// may be added without changing it.
+const CampaignReportVersion = 1
+
+// CampaignReport is the machine-readable summary of a call to Campaign.Run,
+// for archiving and automated checks after a campaign. It is written as
+// JSON to the campaign's Report writer.
+type CampaignReport struct {
+	// Version is CampaignReportVersion.
+	Version int `json:"version"`
+
+	CampaignID string `json:"campaign_id"`
+
+	// StartedAt and FinishedAt delimit the run. DurationMillis is the
+	// time between them in milliseconds.
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+	DurationMillis int64     `json:"duration_ms"`
+
+	// Completed reports whether every recipient has been processed. If
+	// the run stopped early, Error holds the reason.
+	Completed bool   `json:"completed"`
+	Error     string `json:"error,omitempty"`
+
+	// Progress is the campaign's overall progress, including earlier
+	// runs of a resumed campaign.
+	Progress CampaignProgress `json:"progress"`
+
+	// Errors counts the failed results of this run by error code.
+	Errors map[ErrorCode]int `json:"errors"`
+
+	Config CampaignReportConfig `json:"config"`
+}
+
+// CampaignReportConfig is the configuration a campaign ran with.
+type CampaignReportConfig struct {
+	ChunkSize      int                    `json:"chunk_size"`
+	Retries        int                    `json:"retries"`
+	IntervalMillis int64                  `json:"interval_ms,omitempty"`
+	WindowMillis   int64                  `json:"window_ms,omitempty"`
+	Recipients     int                    `json:"recipients,omitempty"`
+	Variants       []CampaignReportWeight `json:"variants,omitempty"`
+	FrequencyCap   bool                   `json:"frequency_cap"`
+	Category       string                 `json:"category,omitempty"`
+}
+
+// CampaignReportWeight is the name and weight of a campaign's variant.
+type CampaignReportWeight struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// writeReport writes the report of a run of c to c.Report.
+func (c *Campaign) writeReport(progress CampaignProgress, errs map[ErrorCode]int, started time.Time, err error) error {
+	finished := now(c.Clock)
+	report := CampaignReport{
+		Version:        CampaignReportVersion,
+		CampaignID:     c.ID,
+		StartedAt:      started,
+		FinishedAt:     finished,
+		DurationMillis: finished.Sub(started).Milliseconds(),
+		Completed:      err == nil,
+		Progress:       progress,
+		Errors:         errs,
+		Config: CampaignReportConfig{
+			ChunkSize:      c.chunkSize(),
+			Retries:        c.Retries,
+			IntervalMillis: c.Interval.Milliseconds(),
+			WindowMillis:   c.Window.Milliseconds(),
+			Recipients:     c.Total,
+			FrequencyCap:   c.FrequencyCap != nil,
+			Category:       c.Category,
+		},
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if c.Source == nil {
+		report.Config.Recipients = len(c.RegistrationIDs)
+	}
+	for _, v := range c.Variants {
+		report.Config.Variants = append(report.Config.Variants, CampaignReportWeight{Name: v.Name, Weight: v.Weight})
+	}
+	return json.NewEncoder(c.Report).Encode(&report)
+}
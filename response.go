@@ -10,6 +10,11 @@ type Response struct {
 	Failure      int      `json:"failure"`
 	CanonicalIDs int      `json:"canonical_ids"`
 	Results      []Result `json:"results"`
+
+	// MulticastIDs lists the multicast IDs of every request made to send
+	// the message, in order, when the Sender retried; the last one equals
+	// MulticastID. Each Result carries the ID of the request it came from.
+	MulticastIDs []int64 `json:"-"`
 }
 
 // Result represents the status of a processed message.
@@ -17,4 +22,15 @@ type Result struct {
 	MessageID      string `json:"message_id"`
 	RegistrationID string `json:"registration_id"`
 	Error          string `json:"error"`
+
+	// MulticastID is the multicast ID of the request that produced this
+	// result, which differs from the Response's when the device was only
+	// reached, or last failed, on an earlier attempt.
+	MulticastID int64 `json:"-"`
+}
+
+// ErrorCode returns the result's error as an ErrorCode. It returns the
+// empty ErrorCode if the message was processed successfully.
+func (r Result) ErrorCode() ErrorCode {
+	return ErrorCode(r.Error)
 }
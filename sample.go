@@ -0,0 +1,94 @@
+package gcm
+
+import (
+	"errors"
+	"hash/fnv"
+)
+
+// SampledOutcomeWriter is an OutcomeWriter that passes only a sample of
+// the per-token outcomes on to another OutcomeWriter, so that reports,
+// audit sinks and logs are not overwhelmed by campaigns producing
+// millions of results. The aggregate counters it keeps are exact.
+//
+// Sampling is deterministic per registration ID, so a device is either
+// always or never reported across requests.
+type SampledOutcomeWriter struct {
+	// W receives the sampled outcomes.
+	W OutcomeWriter
+
+	// Rate is the fraction of outcomes passed on, between 0 and 1.
+	Rate float64
+
+	// KeepFailures passes every failed outcome on regardless of Rate.
+	KeepFailures bool
+
+	// Success and Failure count all outcomes written to the
+	// SampledOutcomeWriter, and Sampled the ones passed on to W.
+	Success int64
+	Failure int64
+	Sampled int64
+}
+
+// Write implements OutcomeWriter.
+func (sw *SampledOutcomeWriter) Write(regIDs []string, resp *Response) error {
+	if sw.W == nil {
+		return errors.New("the sampled writer's W must not be nil")
+	} else if _, err := Outcomes(regIDs, resp); err != nil {
+		return err
+	}
+
+	sample := &Response{MulticastID: resp.MulticastID, MulticastIDs: resp.MulticastIDs}
+	var sampled []string
+	for i, result := range resp.Results {
+		failed := result.Error != ""
+		if failed {
+			sw.Failure++
+		} else {
+			sw.Success++
+		}
+
+		if !(failed && sw.KeepFailures) && !sampleKey(regIDs[i], sw.Rate) {
+			continue
+		}
+		sampled = append(sampled, regIDs[i])
+		sample.Results = append(sample.Results, result)
+		if failed {
+			sample.Failure++
+		} else {
+			sample.Success++
+		}
+	}
+
+	if len(sampled) == 0 {
+		return nil
+	}
+	sw.Sampled += int64(len(sampled))
+	return sw.W.Write(sampled, sample)
+}
+
+// Flush implements OutcomeWriter.
+func (sw *SampledOutcomeWriter) Flush() error {
+	if sw.W == nil {
+		return nil
+	}
+	return sw.W.Flush()
+}
+
+// sampleKey reports whether key falls into a sample of the given rate.
+func sampleKey(key string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	} else if rate <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	// FNV spreads short, similar keys such as sequential numbers poorly
+	// over the high bits, so mix them before comparing.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return float64(x>>11)/(1<<53) < rate
+}
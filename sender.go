@@ -4,12 +4,16 @@ package gcm
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,12 +40,23 @@ const (
 
 	// maxTimeToLive is max time GCM storage can store messages when the device is offline
 	maxTimeToLive = 2419200 // 4 weeks
+
+	// defaultMaxResponseBytes is the size limit of response bodies when
+	// the sender's MaxResponseBytes is zero.
+	defaultMaxResponseBytes = 4 << 20
+
+	// maxPayloadSize is the max size in bytes of the data and notification
+	// payloads of a message.
+	maxPayloadSize = 4096
 )
 
 // Declared as a mutable variable for testing purposes.
 // Use GCMEndpoint by default for backward compatibility.
 var defaultEndpoint = GcmSendEndpoint
 
+// defaultClient is used by senders without an Http client.
+var defaultClient = new(http.Client)
+
 // Sender abstracts the interaction between the application server and the
 // GCM server. The developer must obtain an API key from the Google APIs
 // Console page and pass it to the Sender so that it can perform authorized
@@ -60,10 +75,112 @@ var defaultEndpoint = GcmSendEndpoint
 //
 //		/* ... */
 //	}
+//
+// Unknown fields in the server's response are ignored. If the OnWarning
+// hook is set, it is called once for every unknown field path, which helps
+// noticing when the server starts returning data that should be supported.
 type Sender struct {
 	ApiKey string
 	URL    string
 	Http   *http.Client
+
+	// OnWarning, if not nil, is called for conditions that do not fail
+	// the send but are worth knowing about.
+	OnWarning func(Warning)
+
+	// ReadIdleTimeout, if not zero, aborts a request when no data of the
+	// response body arrives for that long. Unlike the Timeout of the
+	// http.Client, it does not limit the total time spent reading, so a
+	// large multicast response that arrives slowly but steadily is not
+	// cut short while a stalled connection still is.
+	ReadIdleTimeout time.Duration
+
+	// MaxResponseBytes caps the size of the response bodies the sender
+	// reads; a larger body fails the request with a
+	// *ResponseTooLargeError. If zero, 4 MiB is used, far more than the
+	// response to a message to 1000 devices takes. If negative, there is
+	// no limit.
+	MaxResponseBytes int64
+
+	// Signer, if not nil, signs every request after the Authorization
+	// and Content-Type headers have been set.
+	Signer RequestSigner
+
+	// UseCanonicalIDs makes Send retry a device with its canonical
+	// registration ID once an earlier attempt of the same call has
+	// reported one, rather than with the registration ID the caller
+	// passed. Results are still reported in the caller's order, with the
+	// canonical ID in Result.RegistrationID.
+	UseCanonicalIDs bool
+
+	// Strict turns the defaults a Sender silently falls back to into
+	// errors: a nil Http client no longer stands for a zeroed one, and
+	// an empty URL no longer stands for the legacy GCM endpoint.
+	// Production configurations can set it to make sure they never run
+	// on deprecated defaults by accident.
+	Strict bool
+
+	// Duplicates decides what happens to messages that list the same
+	// registration ID more than once. By default they are sent as is.
+	Duplicates DuplicatePolicy
+
+	// Processors are run in order on the final response of every message
+	// the sender sends. If one fails, the response is returned along with
+	// a *ProcessorError.
+	Processors []ResultProcessor
+
+	// MaxInFlight caps the number of HTTP requests the sender has in
+	// flight at once, across all goroutines using it; further requests
+	// wait for one to finish. It is read on the first request, and zero
+	// means no limit.
+	MaxInFlight int
+
+	// StandbyApiKey, if not empty, is a second server key the sender
+	// switches to for good when the server rejects ApiKey with 401
+	// Unauthorized, e.g. because it was revoked by accident. The request
+	// that was rejected is sent again with the standby key.
+	StandbyApiKey string
+
+	// OnFailover, if not nil, is called with the rejection once the
+	// sender switched to StandbyApiKey, so that operators can be alerted.
+	OnFailover func(err error)
+
+	// Simulator, if not nil, answers the sender's requests instead of
+	// the GCM server, and ApiKey may be empty. See NewClientOrSimulator
+	// for enabling it from the environment.
+	Simulator *Simulator
+
+	// OversizePayload, if not nil, is called for messages whose data and
+	// notification payloads exceed the 4096 bytes the server accepts. It
+	// typically stores the full data and returns a small replacement,
+	// such as a URL or ID the application fetches the content from when
+	// it receives the message. The message is sent with the replacement
+	// data instead of failing with MessageTooBig; it is not modified.
+	// Compiled messages are sent as they are.
+	OversizePayload func(msg *Message) (map[string]interface{}, error)
+
+	// SkipValidation skips checking messages and registration IDs and
+	// the pitfall warnings on every send, for pipelines that validate
+	// messages once when they are compiled or enqueued. Messages that are
+	// not well-formed are then sent as they are and rejected by the
+	// server. The OversizePayload hook still runs.
+	SkipValidation bool
+
+	// SLO, if its Target is set, makes Stats report the error budget
+	// left under that objective.
+	SLO SLO
+
+	// Clock, if not nil, is used instead of the system clock to tell
+	// whether messages have expired and for the SLO's window.
+	Clock Clock
+
+	// Smoothing is the weight of the latest request in the Estimates
+	// of the sender's Stats, between 0 and 1. If zero, 0.1 is used.
+	Smoothing float64
+
+	stats    senderStats
+	inFlight inFlightLimit
+	standby  atomic.Bool
 }
 
 // NewClient returns a new sender with the given URL and apiKey.
@@ -90,17 +207,73 @@ func NewClient(urlString, apiKey string) (*Sender, error) {
 	}, nil
 }
 
+// knownHosts are the hosts of the GCM and FCM endpoints.
+var knownHosts = []string{"fcm.googleapis.com", "gcm-http.googleapis.com", "android.googleapis.com"}
+
+// NewVerifiedClient is like NewClient, but also returns an error unless
+// the URL is an https URL of a known GCM or FCM host, or its host is one
+// of allowedHosts. It catches configurations that point production at a
+// mock or staging server by mistake. Allowed hosts may include a port.
+func NewVerifiedClient(urlString, apiKey string, allowedHosts ...string) (*Sender, error) {
+	s, err := NewClient(urlString, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	u, _ := url.Parse(urlString)
+	for _, host := range allowedHosts {
+		if u.Host == host || u.Hostname() == host {
+			return s, nil
+		}
+	}
+	for _, host := range knownHosts {
+		if u.Hostname() == host {
+			if u.Scheme != "https" {
+				return nil, fmt.Errorf("the GCM/FCM endpoint url %q must use https", urlString)
+			}
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("%q is not a known GCM/FCM endpoint url", urlString)
+}
+
+// Warmup establishes a connection to the GCM server ahead of the first
+// send, so that the TCP and TLS handshakes do not add to the latency of
+// the first message after a deploy or scale-up. It sends a HEAD request to
+// the sender's URL; any HTTP response counts as success, since only the
+// pooled connection it leaves behind matters.
+func (s *Sender) Warmup(ctx context.Context) error {
+	if err := checkSender(s); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", s.endpoint(), nil)
+	if err != nil {
+		return err
+	}
+	release, err := s.inFlight.acquire(ctx, s.MaxInFlight)
+	if err != nil {
+		return err
+	}
+	defer release()
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
 // SendNoRetry sends a message to the GCM server without retrying in case of
 // service unavailability. A non-nil error is returned if a non-recoverable
 // error occurs (i.e. if the response status is not "200 OK").
+//
+// The message is sent once even if it has a RetryPolicy.
 func (s *Sender) SendNoRetry(msg *Message) (*Response, error) {
-	if err := checkSender(s); err != nil {
-		return nil, err
-	} else if err := checkMessage(msg); err != nil {
+	c, err := s.prepare(msg, 0)
+	if err != nil {
 		return nil, err
 	}
-
-	return s.send(msg)
+	return s.sendProcessed(context.Background(), c, msg.RegistrationIDs, 0)
 }
 
 // Send sends a message to the GCM server, retrying in case of service
@@ -110,44 +283,213 @@ func (s *Sender) SendNoRetry(msg *Message) (*Response, error) {
 // Note that messages are retried using exponential backoff, and as a
 // result, this method may block for several seconds.
 func (s *Sender) Send(msg *Message, retries int) (*Response, error) {
+	return s.send(context.Background(), msg, retries)
+}
+
+// SendContext is like Send, but gives up as soon as ctx is done, even in
+// the middle of a request or a backoff.
+//
+// Delivery settings attached to ctx by upstream middleware are applied to
+// the message, without modifying it: a priority set with WithPriority is
+// used if the message has none, and a profile set with WithProfile fills
+// in the remaining unset fields and replaces retries with its own Retries.
+func (s *Sender) SendContext(ctx context.Context, msg *Message, retries int) (*Response, error) {
+	if msg != nil {
+		msg, retries = applyContext(ctx, msg, retries)
+	}
+	return s.send(ctx, msg, retries)
+}
+
+func (s *Sender) send(ctx context.Context, msg *Message, retries int) (*Response, error) {
+	c, err := s.prepare(msg, retries)
+	if err != nil {
+		return nil, err
+	}
+	return s.sendProcessed(ctx, c, msg.RegistrationIDs, c.retries(retries))
+}
+
+// prepare checks the sender, msg and retries, applies the sender's hooks
+// to msg and compiles it.
+func (s *Sender) prepare(msg *Message, retries int) (*CompiledMessage, error) {
 	if err := checkSender(s); err != nil {
 		return nil, err
-	} else if err := checkMessage(msg); err != nil {
+	} else if msg == nil {
+		return nil, errors.New("the message must not be nil")
+	} else if retries < 0 {
+		return nil, errors.New("'retries' must not be negative.")
+	}
+	if !s.SkipValidation {
+		if err := checkMessage(msg); err != nil {
+			return nil, err
+		}
+		if s.OnWarning != nil {
+			for _, w := range msg.Pitfalls() {
+				s.warn(w)
+			}
+		}
+	}
+	if s.OversizePayload != nil && payloadSize(msg) > maxPayloadSize {
+		var err error
+		if msg, err = s.fetchTickle(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	return compile(msg)
+}
+
+// SendCompiled sends a precompiled message to the given registration IDs,
+// retrying in case of service unavailability like Send does. Only the
+// list of registration IDs is encoded for each call, so a message compiled
+// once can be fanned out cheaply through any number of Senders.
+func (s *Sender) SendCompiled(c *CompiledMessage, retries int, regIDs ...string) (*Response, error) {
+	return s.SendCompiledContext(context.Background(), c, retries, regIDs...)
+}
+
+// SendCompiledContext is like SendCompiled, but gives up as soon as ctx is
+// done and passes ctx to the sender's processors. The tenant set with
+// WithTenant is honored; priorities and profiles attached to ctx are not,
+// as the message is already compiled.
+func (s *Sender) SendCompiledContext(ctx context.Context, c *CompiledMessage, retries int, regIDs ...string) (*Response, error) {
+	if err := checkSender(s); err != nil {
 		return nil, err
+	} else if c == nil {
+		return nil, errors.New("the compiled message must not be nil")
 	} else if retries < 0 {
 		return nil, errors.New("'retries' must not be negative.")
 	}
+	if !s.SkipValidation {
+		if err := checkRegistrationIDs(regIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.sendProcessed(ctx, c, regIDs, c.retries(retries))
+}
+
+// sendProcessed sends c to regIDs and runs the sender's processors on the
+// response.
+func (s *Sender) sendProcessed(ctx context.Context, c *CompiledMessage, regIDs []string, retries int) (*Response, error) {
+	resp, err := s.sendUnique(ctx, c, regIDs, retries)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.process(ctx, regIDs, resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// sendUnique applies the sender's duplicate policy to regIDs and sends c
+// to them.
+func (s *Sender) sendUnique(ctx context.Context, c *CompiledMessage, regIDs []string, retries int) (*Response, error) {
+	if s.Duplicates == DuplicatesAllow {
+		return s.sendCompiled(ctx, c, regIDs, retries)
+	}
+
+	unique, index := dedupe(regIDs)
+	if len(unique) == len(regIDs) {
+		return s.sendCompiled(ctx, c, regIDs, retries)
+	} else if s.Duplicates == DuplicatesReject {
+		return nil, fmt.Errorf("the message lists %d registration IDs more than once", len(regIDs)-len(unique))
+	}
+
+	resp, err := s.sendCompiled(ctx, c, unique, retries)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, len(regIDs))
+	for i, regID := range regIDs {
+		if j := index[regID]; j < len(resp.Results) {
+			results[i] = resp.Results[j]
+		}
+	}
+	resp.Results = results
+	return resp, nil
+}
+
+func (s *Sender) sendCompiled(ctx context.Context, c *CompiledMessage, regIDs []string, retries int) (*Response, error) {
+	backoff, maxBackoff := backoffInitialDelay, maxBackoffDelay
+	if p := c.retry; p != nil {
+		if p.InitialBackoff > 0 {
+			backoff = int(p.InitialBackoff / time.Millisecond)
+		}
+		if p.MaxBackoff > 0 {
+			maxBackoff = int(p.MaxBackoff / time.Millisecond)
+		}
+		if backoff = min(backoff, maxBackoff); backoff < 1 {
+			backoff = 1
+		}
+	}
 
-	// Send the message for the first time.
-	resp, err := s.send(msg)
+	// Send the message for the first time. The encoded body is kept so
+	// that retries addressed to the same registration IDs can reuse it.
+	ttl, ok := c.timeToLive(now(s.Clock))
+	if !ok {
+		return nil, errors.New("the message expired before it could be sent")
+	}
+	body, err := c.body(regIDs, ttl)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.sendBody(ctx, body)
 	if err != nil {
 		return nil, err
-	} else if resp.Failure == 0 || retries == 0 {
+	} else if (resp.Failure == 0 || retries == 0) && len(resp.Results) == len(regIDs) {
 		return resp, nil
 	}
 
-	// One or more messages failed to send.
-	regIDs := msg.RegistrationIDs
+	// One or more messages failed to send, or the results do not match
+	// the registration IDs and have to be reconciled.
 	allResults := make(map[string]Result, len(regIDs))
-	backoff := backoffInitialDelay
-	for i := 0; updateStatus(msg, resp, allResults) > 0 && i < retries; i++ {
+	replacements := make(map[string]string)
+	sentRegIDs := regIDs
+	multicastIDs := []int64{resp.MulticastID}
+	unsentRegIDs := s.updateStatus(sentRegIDs, resp, allResults)
+	s.updateReplacements(sentRegIDs, allResults, replacements)
+	for i := 0; len(unsentRegIDs) > 0 && i < retries; i++ {
 		sleepTime := backoff/2 + rand.Intn(backoff)
-		time.Sleep(time.Duration(sleepTime) * time.Millisecond)
-		backoff = min(2*backoff, maxBackoffDelay)
-		if resp, err = s.send(msg); err != nil {
-			msg.RegistrationIDs = regIDs
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(sleepTime) * time.Millisecond):
+		}
+		backoff = min(2*backoff, maxBackoff)
+
+		// Stop retrying once the message has outlived its TimeToLive;
+		// the devices that were not reached keep their last error.
+		sentTTL := ttl
+		if ttl, ok = c.timeToLive(now(s.Clock)); !ok {
+			break
+		}
+
+		// The unsent registration IDs are an ordered subset of the ones
+		// sent last time, so the body only changes if the count or the
+		// remaining TimeToLive does, or canonical IDs are substituted.
+		wireRegIDs, replaced := substitute(unsentRegIDs, replacements)
+		if len(unsentRegIDs) != len(sentRegIDs) || ttl != sentTTL || replaced {
+			if body, err = c.body(wireRegIDs, ttl); err != nil {
+				return nil, err
+			}
+		}
+		sentRegIDs = unsentRegIDs
+		s.stats.retry()
+		if resp, err = s.sendBody(ctx, body); err != nil {
 			return nil, err
 		}
+		multicastIDs = append(multicastIDs, resp.MulticastID)
+		unsentRegIDs = s.updateStatus(sentRegIDs, resp, allResults)
+		s.updateReplacements(sentRegIDs, allResults, replacements)
 	}
 
-	// Bring the message back to its original state.
-	msg.RegistrationIDs = regIDs
-
 	// Create a Response containing the overall results.
 	finalResults := make([]Result, len(regIDs))
 	var success, failure, canonicalIDs int
 	for i := 0; i < len(regIDs); i++ {
 		result, _ := allResults[regIDs[i]]
+		if result.RegistrationID == "" {
+			result.RegistrationID = replacements[regIDs[i]]
+		}
 		finalResults[i] = result
 		if result.MessageID != "" {
 			if result.RegistrationID != "" {
@@ -166,55 +508,319 @@ func (s *Sender) Send(msg *Message, retries int) (*Response, error) {
 		Failure:      failure,
 		CanonicalIDs: canonicalIDs,
 		Results:      finalResults,
+		MulticastIDs: multicastIDs,
 	}, nil
 }
 
-func (s *Sender) send(msg *Message) (*Response, error) {
-	var buf bytes.Buffer
-	encoder := json.NewEncoder(&buf)
-	if err := encoder.Encode(msg); err != nil {
+// fetchTickle returns a copy of msg whose data is replaced by what the
+// OversizePayload hook returns.
+func (s *Sender) fetchTickle(msg *Message) (*Message, error) {
+	data, err := s.OversizePayload(msg)
+	if err != nil {
+		return nil, err
+	}
+	m := *msg
+	m.Data = data
+	if size := payloadSize(&m); size > maxPayloadSize {
+		return nil, fmt.Errorf("the replacement payload of %d bytes exceeds %d bytes", size, maxPayloadSize)
+	}
+	return &m, nil
+}
+
+// SendWithProfile sends a message to the GCM server using the delivery
+// settings and retry count of the given profile. Fields that are already
+// set on the message take precedence over the profile, and the message
+// itself is left unmodified.
+func (s *Sender) SendWithProfile(msg *Message, p Profile) (*Response, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	} else if msg == nil {
+		return nil, errors.New("the message must not be nil")
+	}
+	return s.Send(p.apply(msg), p.Retries)
+}
+
+// sendBody posts an already encoded message to the GCM server and records
+// the outcome in the sender's statistics.
+func (s *Sender) sendBody(ctx context.Context, body []byte) (*Response, error) {
+	// The slot is taken before the request is signed, so that a wait for
+	// it neither ages the signature nor counts towards the latency.
+	release, err := s.inFlight.acquire(ctx, s.MaxInFlight)
+	if err != nil {
 		return nil, err
 	}
+	defer release()
+
+	start := time.Now()
+	tenant, _ := TenantFromContext(ctx)
+	apiKey := s.apiKey()
+	resp, err := s.post(ctx, body, apiKey)
+	if se, ok := err.(*statusError); ok && se.code == http.StatusUnauthorized && s.failover(apiKey, err) {
+		s.record(body, start, tenant, resp, err)
+		start = time.Now()
+		resp, err = s.post(ctx, body, s.StandbyApiKey)
+	}
+	s.record(body, start, tenant, resp, err)
+	return resp, err
+}
+
+// record records the outcome of a request started at start in the
+// sender's statistics.
+func (s *Sender) record(body []byte, start time.Time, tenant string, resp *Response, err error) {
+	smoothing := s.Smoothing
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = defaultSmoothing
+	}
+	s.stats.record(request{
+		bytes:    len(body),
+		latency:  time.Since(start),
+		at:       now(s.Clock),
+		resp:     resp,
+		err:      err,
+		endpoint: s.endpoint(),
+		tenant:   tenant,
+	}, s.SLO, smoothing)
+}
+
+// UsingStandby reports whether the sender switched to its StandbyApiKey.
+func (s *Sender) UsingStandby() bool {
+	return s.standby.Load()
+}
+
+// apiKey returns the server key the sender currently authenticates with.
+func (s *Sender) apiKey() string {
+	if s.standby.Load() {
+		return s.StandbyApiKey
+	}
+	return s.ApiKey
+}
+
+// failover switches the sender to its standby key after apiKey was
+// rejected with err. It reports whether the request should be sent again,
+// which is the case unless apiKey already was the standby key or there is
+// none.
+func (s *Sender) failover(apiKey string, err error) bool {
+	if s.StandbyApiKey == "" || apiKey == s.StandbyApiKey {
+		return false
+	}
+	if s.standby.CompareAndSwap(false, true) && s.OnFailover != nil {
+		s.OnFailover(err)
+	}
+	return true
+}
+
+// client returns the HTTP client requests are made with.
+func (s *Sender) client() *http.Client {
+	if s.Simulator != nil {
+		return &http.Client{Transport: s.Simulator}
+	} else if s.Http == nil {
+		return defaultClient
+	}
+	return s.Http
+}
+
+// endpoint returns the URL requests are made to. Previously, by default,
+// this library used the GCM endpoint. To keep backwards compatibility, it
+// is used when the URL is not specified.
+func (s *Sender) endpoint() string {
+	if s.URL == "" {
+		return defaultEndpoint
+	}
+	return s.URL
+}
+
+// ResponseTooLargeError is returned when a response body exceeds the
+// sender's MaxResponseBytes.
+type ResponseTooLargeError struct {
+	// Limit is the MaxResponseBytes in effect.
+	Limit int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("the response body exceeds %d bytes", e.Limit)
+}
+
+// statusError is returned by post for responses other than 200 OK.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("invalid status code %d: %s", e.code, e.status)
+}
 
-	req, err := http.NewRequest("POST", s.URL, &buf)
+// post posts an already encoded message to the GCM server. The body is
+// wrapped in a bytes.Reader, so http.NewRequestWithContext sets Request.GetBody and
+// the transport can replay it (e.g. on an HTTP/2 connection reset) without
+// encoding the message again.
+func (s *Sender) post(ctx context.Context, body []byte, apiKey string) (*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.endpoint(), bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("key=%s", s.ApiKey))
+	req.Header.Add("Authorization", fmt.Sprintf("key=%s", apiKey))
 	req.Header.Add("Content-Type", "application/json")
+	if s.Signer != nil {
+		if err := s.Signer.SignRequest(req, body); err != nil {
+			return nil, err
+		}
+	}
 
-	resp, err := s.Http.Do(req)
+	resp, err := s.client().Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("invalid status code %d: %s", resp.StatusCode, resp.Status)
+		return nil, &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+
+	var r io.Reader = resp.Body
+	if s.ReadIdleTimeout > 0 {
+		ir := newIdleReader(resp.Body, s.ReadIdleTimeout)
+		defer ir.stop()
+		r = ir
+	}
+	limit := s.MaxResponseBytes
+	if limit == 0 {
+		limit = defaultMaxResponseBytes
+	}
+	if limit > 0 {
+		r = &limitReader{r: r, limit: limit, n: limit}
 	}
 
 	var response Response
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&response); err != nil {
-		return nil, err
+	decoder := json.NewDecoder(r)
+	if s.OnWarning == nil {
+		if err := decoder.Decode(&response); err != nil {
+			return nil, err
+		}
+	} else {
+		// Keep the raw response to look for fields that are not known.
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &response); err != nil {
+			return nil, err
+		}
+		s.warnUnknownFields(raw)
+	}
+	response.MulticastIDs = []int64{response.MulticastID}
+	for i := range response.Results {
+		response.Results[i].MulticastID = response.MulticastID
 	}
 
 	return &response, err
 }
 
+// inFlightLimit is a semaphore bounding the requests of a Sender. The
+// zero value is ready to use.
+type inFlightLimit struct {
+	once sync.Once
+	sem  chan struct{}
+}
+
+// acquire waits until fewer than max requests are in flight, or ctx is
+// done, and returns a function releasing the slot. A max of zero or less
+// never waits.
+func (l *inFlightLimit) acquire(ctx context.Context, max int) (func(), error) {
+	l.once.Do(func() {
+		if max > 0 {
+			l.sem = make(chan struct{}, max)
+		}
+	})
+	if l.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return func() { <-l.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // updateStatus updates the status of the messages sent to devices and
-// returns the number of recoverable errors that could be retried.
-func updateStatus(msg *Message, resp *Response, allResults map[string]Result) int {
+// returns the registration IDs with recoverable errors that could be retried.
+//
+// Results are matched to regIDs by position, and those beyond the number
+// of registration IDs sent are ignored. Since a registration ID may occur
+// more than once, a failed result never replaces an earlier success for
+// the same registration ID, so that it is counted once.
+func (s *Sender) updateStatus(regIDs []string, resp *Response, allResults map[string]Result) []string {
+	if len(resp.Results) != len(regIDs) {
+		s.warn(Warning{Code: WarningResultCount, Field: "results", Count: len(resp.Results) - len(regIDs)})
+	}
+
 	unsentRegIDs := make([]string, 0, resp.Failure)
-	for i := 0; i < len(resp.Results); i++ {
-		regID := msg.RegistrationIDs[i]
-		allResults[regID] = resp.Results[i]
-		if resp.Results[i].Error == "Unavailable" {
+	duplicates := 0
+	for i := 0; i < len(resp.Results) && i < len(regIDs); i++ {
+		regID := regIDs[i]
+		result := resp.Results[i]
+		if prev, ok := allResults[regID]; ok && prev.MessageID != "" && result.MessageID == "" {
+			duplicates++
+			continue
+		}
+		allResults[regID] = result
+		if result.ErrorCode() == ErrorUnavailable {
 			unsentRegIDs = append(unsentRegIDs, regID)
 		}
 	}
-	msg.RegistrationIDs = unsentRegIDs
-	return len(unsentRegIDs)
+	if duplicates > 0 {
+		s.warn(Warning{Code: WarningDuplicateResult, Field: "results", Count: duplicates})
+	}
+	return unsentRegIDs
+}
+
+// updateReplacements records the canonical IDs reported for regIDs if the
+// sender retries with canonical IDs.
+func (s *Sender) updateReplacements(regIDs []string, allResults map[string]Result, replacements map[string]string) {
+	if !s.UseCanonicalIDs {
+		return
+	}
+	for _, regID := range regIDs {
+		if canonicalID := allResults[regID].RegistrationID; canonicalID != "" {
+			replacements[regID] = canonicalID
+		}
+	}
+}
+
+// substitute returns regIDs with every registration ID that has a
+// replacement replaced, and whether there were any.
+func substitute(regIDs []string, replacements map[string]string) ([]string, bool) {
+	if len(replacements) == 0 {
+		return regIDs, false
+	}
+	var substituted []string
+	for i, regID := range regIDs {
+		if canonicalID, ok := replacements[regID]; ok {
+			if substituted == nil {
+				substituted = append([]string(nil), regIDs...)
+			}
+			substituted[i] = canonicalID
+		}
+	}
+	if substituted == nil {
+		return regIDs, false
+	}
+	return substituted, true
+}
+
+// dedupe returns the distinct registration IDs of regIDs in order of first
+// appearance, and the index of each in that list.
+func dedupe(regIDs []string) ([]string, map[string]int) {
+	index := make(map[string]int, len(regIDs))
+	unique := make([]string, 0, len(regIDs))
+	for _, regID := range regIDs {
+		if _, ok := index[regID]; !ok {
+			index[regID] = len(unique)
+			unique = append(unique, regID)
+		}
+	}
+	return unique, index
 }
 
 // min returns the smaller of two integers. For exciting religious wars
@@ -227,21 +833,19 @@ func min(a, b int) int {
 	return b
 }
 
-// checkSender returns an error if the sender is not well-formed and
-// initializes a zeroed http.Client if one has not been provided.
+// checkSender returns an error if the sender is not well-formed. Unless the
+// sender is strict, a missing Http client or URL is not an error; the
+// sender then uses a zeroed http.Client and the default endpoint, without
+// being modified, so that it is safe for concurrent use.
 func checkSender(sender *Sender) error {
-	if sender.ApiKey == "" {
+	if sender.ApiKey == "" && sender.Simulator == nil {
 		return errors.New("the sender's API key must not be empty")
 	}
 
-	if sender.Http == nil {
-		sender.Http = new(http.Client)
-	}
-
-	// Previously, by default, this library uses gcm endpoint.
-	// To keep backwards compatibility, use GCM endpoint when not specified.
-	if sender.URL == "" {
-		sender.URL = defaultEndpoint
+	if sender.Strict && sender.Http == nil {
+		return errors.New("the sender's Http client must not be nil in strict mode")
+	} else if sender.Strict && sender.URL == "" {
+		return errors.New("the sender's URL must not be empty in strict mode")
 	}
 	return nil
 }
@@ -250,15 +854,37 @@ func checkSender(sender *Sender) error {
 func checkMessage(msg *Message) error {
 	if msg == nil {
 		return errors.New("the message must not be nil")
-	} else if msg.RegistrationIDs == nil {
+	} else if err := checkRegistrationIDs(msg.RegistrationIDs); err != nil {
+		return err
+	}
+	return checkPayload(msg)
+}
+
+// checkRegistrationIDs returns an error if the list of registration IDs
+// a message is addressed to is empty or too long.
+func checkRegistrationIDs(regIDs []string) error {
+	if regIDs == nil {
 		return errors.New("the message's RegistrationIDs field must not be nil")
-	} else if len(msg.RegistrationIDs) == 0 {
+	} else if len(regIDs) == 0 {
 		return errors.New("the message must specify at least one registration ID")
-	} else if len(msg.RegistrationIDs) > maxRegistrationIDs {
+	} else if len(regIDs) > maxRegistrationIDs {
 		return errors.New("the message may specify at most 1000 registration IDs")
-	} else if msg.TimeToLive < 0 || maxTimeToLive < msg.TimeToLive {
+	}
+	return nil
+}
+
+// checkPayload returns an error if any field of the message other than
+// its registration IDs is not well-formed.
+func checkPayload(msg *Message) error {
+	if msg.TimeToLive < 0 || maxTimeToLive < msg.TimeToLive {
 		return errors.New("the message's TimeToLive field must be an integer " +
 			"between 0 and 2419200 (4 weeks)")
+	} else if p := msg.RetryPolicy; p != nil && (p.Retries < 0 || p.InitialBackoff < 0 || p.MaxBackoff < 0) {
+		return errors.New("the message's RetryPolicy must not be negative")
+	} else if msg.ZeroTimeToLive && msg.TimeToLive != 0 {
+		return errors.New("the message's TimeToLive field must be 0 if ZeroTimeToLive is set")
+	} else if msg.Priority != "" && msg.Priority != PriorityNormal && msg.Priority != PriorityHigh {
+		return fmt.Errorf("the message's Priority field must be %q or %q", PriorityNormal, PriorityHigh)
 	}
 	return nil
 }
@@ -1,11 +1,16 @@
 package gcm
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testResponse struct {
@@ -90,6 +95,14 @@ func TestSendInvalidMessage(t *testing.T) {
 				TimeToLive:      2419201,
 			},
 		},
+
+		// test should fail when message Priority field is unknown
+		{
+			&Message{
+				RegistrationIDs: []string{"1"},
+				Priority:        "urgent",
+			},
+		},
 	}
 
 	server := startTestServer(t, []*testResponse{})
@@ -113,12 +126,13 @@ func TestSend(t *testing.T) {
 		failure         int
 		success         bool
 	}{
+		// A device without a result is reported as failed.
 		{
 			[]*testResponse{
 				{Response: &Response{}},
 			},
 			0,
-			0,
+			1,
 			true,
 		},
 
@@ -200,3 +214,445 @@ func TestSend(t *testing.T) {
 		server.Close()
 	}
 }
+
+func TestSendWithProfile(t *testing.T) {
+	var got Message
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("failed to decode request: %s", err)
+		}
+		json.NewEncoder(w).Encode(&Response{Success: 1, Results: []Result{{MessageID: "id"}}})
+	}))
+	defer server.Close()
+
+	sender, err := NewClient(server.URL, "testAPIKey")
+	if err != nil {
+		t.Fatalf("Failed to setup sender client: %s", err)
+	}
+
+	msg := NewMessage(map[string]interface{}{"key": "value"}, "1")
+	msg.TimeToLive = 60
+	if _, err := sender.SendWithProfile(msg, ProfileMarketing); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+
+	if got.Priority != PriorityNormal || got.CollapseKey != "marketing" || !got.DelayWhileIdle {
+		t.Fatalf("profile was not applied: %+v", got)
+	}
+	if got.TimeToLive != 60 {
+		t.Fatalf("TimeToLive %d, want message value 60", got.TimeToLive)
+	}
+	if msg.Priority != "" || msg.CollapseKey != "" {
+		t.Fatalf("SendWithProfile modified the message: %+v", msg)
+	}
+}
+
+func TestSendRetryBody(t *testing.T) {
+	var bodies []Message
+	responses := []*Response{
+		{MulticastID: 1, Failure: 2, Results: []Result{{Error: "Unavailable"}, {Error: "Unavailable"}}},
+		{MulticastID: 2, Success: 1, Failure: 1, Results: []Result{{MessageID: "a"}, {Error: "Unavailable"}}},
+		{MulticastID: 3, Success: 1, Results: []Result{{MessageID: "b"}}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Fatalf("failed to decode request: %s", err)
+		}
+		json.NewEncoder(w).Encode(responses[len(bodies)])
+		bodies = append(bodies, msg)
+	}))
+	defer server.Close()
+
+	sender, err := NewClient(server.URL, "testAPIKey")
+	if err != nil {
+		t.Fatalf("Failed to setup sender client: %s", err)
+	}
+
+	resp, err := sender.Send(NewMessage(nil, "1", "2"), 2)
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if resp.Success != 2 {
+		t.Fatalf("number of success %d, want 2", resp.Success)
+	}
+
+	want := [][]string{{"1", "2"}, {"1", "2"}, {"2"}}
+	for i, ids := range want {
+		if fmt.Sprint(bodies[i].RegistrationIDs) != fmt.Sprint(ids) {
+			t.Fatalf("attempt #%d sent to %v, want %v", i, bodies[i].RegistrationIDs, ids)
+		}
+	}
+	if got := fmt.Sprint(resp.MulticastIDs); got != "[1 2 3]" {
+		t.Fatalf("multicast IDs %s, want [1 2 3]", got)
+	}
+	if resp.Results[0].MulticastID != 2 || resp.Results[1].MulticastID != 3 {
+		t.Fatalf("results %+v, want multicast IDs 2 and 3", resp.Results)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer server.Close()
+
+	sender, err := NewClient(server.URL, "testAPIKey")
+	if err != nil {
+		t.Fatalf("Failed to setup sender client: %s", err)
+	}
+
+	if err := sender.Warmup(context.Background()); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if len(methods) != 1 || methods[0] != "HEAD" {
+		t.Fatalf("server received %v, want a single HEAD request", methods)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sender.Warmup(ctx); err == nil {
+		t.Fatal("test should fail when the context is canceled")
+	}
+}
+
+func TestSendUseCanonicalIDs(t *testing.T) {
+	var bodies []Message
+	responses := []*Response{
+		{Failure: 1, Results: []Result{{Error: "Unavailable", RegistrationID: "new"}}},
+		{Success: 1, Results: []Result{{MessageID: "id"}}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Fatalf("failed to decode request: %s", err)
+		}
+		json.NewEncoder(w).Encode(responses[len(bodies)])
+		bodies = append(bodies, msg)
+	}))
+	defer server.Close()
+
+	sender := &Sender{ApiKey: "test", URL: server.URL, UseCanonicalIDs: true}
+	resp, err := sender.Send(NewMessage(nil, "old"), 1)
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if got := bodies[1].RegistrationIDs; len(got) != 1 || got[0] != "new" {
+		t.Fatalf("retry was sent to %v, want [new]", got)
+	}
+	if resp.Success != 1 || resp.Results[0].RegistrationID != "new" {
+		t.Fatalf("response %+v, want success with canonical ID", resp)
+	}
+}
+
+func TestSendDuplicates(t *testing.T) {
+	var got [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Fatalf("failed to decode request: %s", err)
+		}
+		got = append(got, msg.RegistrationIDs)
+		resp := &Response{Success: len(msg.RegistrationIDs), Results: make([]Result, len(msg.RegistrationIDs))}
+		for i, regID := range msg.RegistrationIDs {
+			resp.Results[i].MessageID = "id-" + regID
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	sender := &Sender{ApiKey: "test", URL: server.URL, Duplicates: DuplicatesReject}
+	if _, err := sender.Send(NewMessage(nil, "1", "2", "1"), 0); err == nil {
+		t.Fatal("test should fail when registration IDs are duplicated")
+	}
+	if len(got) != 0 {
+		t.Fatalf("server received %v, want nothing", got)
+	}
+
+	sender.Duplicates = DuplicatesRemove
+	resp, err := sender.Send(NewMessage(nil, "1", "2", "1"), 0)
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if fmt.Sprint(got) != "[[1 2]]" {
+		t.Fatalf("server received %v, want [[1 2]]", got)
+	}
+	if resp.Success != 2 || len(resp.Results) != 3 || resp.Results[2].MessageID != "id-1" {
+		t.Fatalf("response %+v", resp)
+	}
+}
+
+func TestSendStrict(t *testing.T) {
+	server := startTestServer(t, []*testResponse{
+		{Response: &Response{Success: 1, Results: []Result{{MessageID: "id"}}}},
+	})
+	defer server.Close()
+
+	cases := []*Sender{
+		{ApiKey: "test", Strict: true, URL: server.URL},
+		{ApiKey: "test", Strict: true, Http: http.DefaultClient},
+	}
+	for i, sender := range cases {
+		if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err == nil {
+			t.Fatalf("#%d expect strict sender to fail", i)
+		}
+	}
+
+	sender := &Sender{ApiKey: "test", Strict: true, URL: server.URL, Http: http.DefaultClient}
+	if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+}
+
+func TestSendMaxInFlight(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, peak int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > peak {
+			peak = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		json.NewEncoder(w).Encode(&Response{Success: 1, Results: []Result{{MessageID: "id"}}})
+	}))
+	defer server.Close()
+
+	sender := &Sender{ApiKey: "test", URL: server.URL, MaxInFlight: 2}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err != nil {
+				t.Errorf("expect to be success: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if peak != 2 {
+		t.Fatalf("peak of %d requests in flight, want 2", peak)
+	}
+}
+
+func TestSendMaxInFlightSignsAfterWait(t *testing.T) {
+	var mu sync.Mutex
+	var oldest time.Duration
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signedAt, _ := strconv.ParseInt(r.Header.Get("X-Signed-At"), 10, 64)
+		mu.Lock()
+		if age := time.Since(time.Unix(0, signedAt)); age > oldest {
+			oldest = age
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode(&Response{Success: 1, Results: []Result{{MessageID: "id"}}})
+	}))
+	defer server.Close()
+
+	sender := &Sender{
+		ApiKey:      "test",
+		URL:         server.URL,
+		MaxInFlight: 1,
+		Signer: RequestSignerFunc(func(req *http.Request, body []byte) error {
+			req.Header.Set("X-Signed-At", strconv.FormatInt(time.Now().UnixNano(), 10))
+			return nil
+		}),
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err != nil {
+				t.Errorf("expect to be success: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if oldest > 40*time.Millisecond {
+		t.Fatalf("a signature was %s old when it arrived, want it signed after the wait", oldest)
+	}
+	if latency := sender.Stats().AverageLatency; latency > 90*time.Millisecond {
+		t.Fatalf("average latency %s, want it to exclude the wait for a slot", latency)
+	}
+}
+
+func TestSendStandbyApiKey(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Authorization")
+		keys = append(keys, key)
+		if key != "key=standby" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(&Response{Success: 1, Results: []Result{{MessageID: "id"}}})
+	}))
+	defer server.Close()
+
+	var failovers int
+	sender := &Sender{ApiKey: "primary", StandbyApiKey: "standby", URL: server.URL}
+	sender.OnFailover = func(err error) { failovers++ }
+	for i := 0; i < 2; i++ {
+		if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err != nil {
+			t.Fatalf("#%d expect to be success: %s", i, err)
+		}
+	}
+	if want := "[key=primary key=standby key=standby]"; fmt.Sprint(keys) != want {
+		t.Fatalf("keys %v, want %s", keys, want)
+	}
+	if failovers != 1 || !sender.UsingStandby() {
+		t.Fatalf("%d failovers, want 1 and the standby key in use", failovers)
+	}
+
+	sender = &Sender{ApiKey: "primary", URL: server.URL}
+	if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err == nil {
+		t.Fatal("test should fail without a standby key")
+	}
+}
+
+func TestSendOversizePayload(t *testing.T) {
+	var bodies []Message
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Fatalf("failed to decode request: %s", err)
+		}
+		bodies = append(bodies, msg)
+		json.NewEncoder(w).Encode(&Response{Success: 1, Results: []Result{{MessageID: "id"}}})
+	}))
+	defer server.Close()
+
+	stored := make(map[string]interface{})
+	sender := &Sender{ApiKey: "test", URL: server.URL}
+	sender.OversizePayload = func(msg *Message) (map[string]interface{}, error) {
+		stored["42"] = msg.Data
+		return map[string]interface{}{"fetch": "42"}, nil
+	}
+
+	small := NewMessage(map[string]interface{}{"body": "short"}, "1")
+	large := NewMessage(map[string]interface{}{"body": strings.Repeat("x", 5000)}, "1")
+	for _, msg := range []*Message{small, large} {
+		if _, err := sender.SendNoRetry(msg); err != nil {
+			t.Fatalf("expect to be success: %s", err)
+		}
+	}
+	if bodies[0].Data["body"] != "short" {
+		t.Fatalf("small message sent with data %v, want it unchanged", bodies[0].Data)
+	}
+	if bodies[1].Data["fetch"] != "42" || stored["42"] == nil {
+		t.Fatalf("large message sent with data %v, want a fetch tickle", bodies[1].Data)
+	}
+	if len(large.Data["body"].(string)) != 5000 {
+		t.Fatal("the large message must not be modified")
+	}
+
+	// Skipping validation does not skip the hook.
+	sender.SkipValidation = true
+	if _, err := sender.SendNoRetry(large); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if bodies[2].Data["fetch"] != "42" {
+		t.Fatalf("large message sent with data %v without validation, want a fetch tickle", bodies[2].Data)
+	}
+	sender.SkipValidation = false
+
+	sender.OversizePayload = func(msg *Message) (map[string]interface{}, error) {
+		return msg.Data, nil
+	}
+	if _, err := sender.SendNoRetry(large); err == nil {
+		t.Fatal("test should fail when the replacement is still too large")
+	}
+}
+
+func TestSendSkipValidation(t *testing.T) {
+	var priorities []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Fatalf("failed to decode request: %s", err)
+		}
+		priorities = append(priorities, msg.Priority)
+		json.NewEncoder(w).Encode(&Response{Success: 1, Results: []Result{{MessageID: "id"}}})
+	}))
+	defer server.Close()
+
+	sender := &Sender{ApiKey: "test", URL: server.URL, SkipValidation: true}
+	if _, err := sender.SendNoRetry(&Message{RegistrationIDs: []string{"1"}, Priority: "urgent"}); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if len(priorities) != 1 || priorities[0] != "urgent" {
+		t.Fatalf("server received priorities %v, want the message sent unchecked", priorities)
+	}
+	if _, err := sender.SendNoRetry(nil); err == nil {
+		t.Fatal("test should fail for a nil message")
+	}
+}
+
+func TestNewVerifiedClient(t *testing.T) {
+	cases := []struct {
+		url     string
+		allowed []string
+		ok      bool
+	}{
+		{GcmSendEndpoint, nil, true},
+		{"https://fcm.googleapis.com/fcm/send", nil, true},
+		{"http://fcm.googleapis.com/fcm/send", nil, false},
+		{"https://fcm.staging.example.com/fcm/send", nil, false},
+		{"https://fcm.staging.example.com/fcm/send", []string{"fcm.staging.example.com"}, true},
+		{"http://127.0.0.1:8080/send", []string{"127.0.0.1:8080"}, true},
+		{"http://127.0.0.1:8080/send", []string{"127.0.0.1:9090"}, false},
+	}
+
+	for i, tc := range cases {
+		_, err := NewVerifiedClient(tc.url, "testAPIKey", tc.allowed...)
+		if ok := err == nil; ok != tc.ok {
+			t.Fatalf("#%d NewVerifiedClient(%q, %v) error %v, want success %v", i, tc.url, tc.allowed, err, tc.ok)
+		}
+	}
+}
+
+func TestSendRetryPolicy(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		json.NewEncoder(w).Encode(&Response{Failure: 1, Results: []Result{{Error: "Unavailable"}}})
+	}))
+	defer server.Close()
+
+	sender := &Sender{ApiKey: "test", URL: server.URL}
+	msg := NewMessage(nil, "1")
+	msg.RetryPolicy = &RetryPolicy{Retries: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+	start := time.Now()
+	resp, err := sender.Send(msg, 0)
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if requests != 4 || resp.Failure != 1 {
+		t.Fatalf("server received %d requests, want 4", requests)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("retries took %s, want the policy's short backoff", elapsed)
+	}
+
+	requests = 0
+	if _, err := sender.SendNoRetry(msg); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if requests != 1 {
+		t.Fatalf("SendNoRetry made %d requests, want 1", requests)
+	}
+
+	msg.RetryPolicy = &RetryPolicy{Retries: -1}
+	if _, err := sender.Send(msg, 0); err == nil {
+		t.Fatal("test should fail when the retry policy is negative")
+	}
+}
@@ -0,0 +1,37 @@
+package gcm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHMACSigner(t *testing.T) {
+	signer := &HMACSigner{Key: []byte("secret")}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := signer.Sign(r.Header.Get("X-Signature-Timestamp"), r.Method, r.URL.Path, body)
+		if got := r.Header.Get("X-Signature"); got != want {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Authorization") != "key=test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(&Response{Success: 1, Results: []Result{{MessageID: "id"}}})
+	}))
+	defer server.Close()
+
+	sender := &Sender{ApiKey: "test", URL: server.URL + "/fcm/send", Signer: signer}
+	if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+
+	sender.Signer = &HMACSigner{Key: []byte("wrong")}
+	if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err == nil {
+		t.Fatal("test should fail when the signature is wrong")
+	}
+}
@@ -0,0 +1,120 @@
+package gcm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// SimulateEnv is the environment variable that, when set to a non-empty
+// value, makes NewClientOrSimulator return a simulating Sender, so that
+// local development needs neither credentials nor network access. Other
+// constructors and Senders ignore it.
+const SimulateEnv = "GCM_SIMULATE"
+
+// NewClientOrSimulator returns a Sender with a new Simulator if the
+// SimulateEnv environment variable is set, and NewClient(urlString,
+// apiKey) otherwise. The environment is read once, by this call.
+func NewClientOrSimulator(urlString, apiKey string) (*Sender, error) {
+	if os.Getenv(SimulateEnv) != "" {
+		return &Sender{URL: urlString, ApiKey: apiKey, Simulator: new(Simulator)}, nil
+	}
+	return NewClient(urlString, apiKey)
+}
+
+// Simulator answers a Sender's requests in place of the GCM server. It
+// records every message and synthesizes a response from Result. Set it as
+// the Sender's Simulator; the sender then needs no API key.
+type Simulator struct {
+	// Result, if not nil, returns the result for a registration ID.
+	// By default every registration ID succeeds.
+	Result func(regID string) Result
+
+	// OnMessage, if not nil, is called with every message received,
+	// e.g. to log it.
+	OnMessage func(msg *Message)
+
+	// Redact, if not nil, is applied to messages before they are passed
+	// to OnMessage. Messages returns them unredacted.
+	Redact Redactor
+
+	mu          sync.Mutex
+	messages    []*Message
+	multicastID int64
+}
+
+// Messages returns the messages received so far, in order.
+func (sim *Simulator) Messages() []*Message {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return append([]*Message(nil), sim.messages...)
+}
+
+// RoundTrip implements http.RoundTripper. HEAD requests are answered
+// with an empty 200 OK, as is done by Warmup.
+func (sim *Simulator) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if req.Method == "HEAD" {
+		return sim.response(req, nil), nil
+	}
+
+	var msg Message
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("simulator: failed to decode message: %s", err)
+	}
+
+	sim.mu.Lock()
+	sim.messages = append(sim.messages, &msg)
+	sim.multicastID++
+	resp := &Response{MulticastID: sim.multicastID}
+	for i, regID := range msg.RegistrationIDs {
+		result := Result{MessageID: fmt.Sprintf("0:simulated-%d-%d", sim.multicastID, i)}
+		if sim.Result != nil {
+			result = sim.Result(regID)
+		}
+		if result.Error != "" {
+			resp.Failure++
+		} else {
+			resp.Success++
+			if result.RegistrationID != "" {
+				resp.CanonicalIDs++
+			}
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	sim.mu.Unlock()
+
+	if sim.OnMessage != nil {
+		if sim.Redact != nil {
+			sim.OnMessage(sim.Redact(&msg))
+		} else {
+			sim.OnMessage(&msg)
+		}
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	return sim.response(req, body), nil
+}
+
+// response returns a 200 OK response to req with the given body.
+func (sim *Simulator) response(req *http.Request, body []byte) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,72 @@
+package gcm
+
+import "testing"
+
+func TestSimulator(t *testing.T) {
+	sim := &Simulator{Result: func(regID string) Result {
+		if regID == "gone" {
+			return Result{Error: "NotRegistered"}
+		}
+		return Result{MessageID: "id-" + regID}
+	}}
+	sender := &Sender{Simulator: sim}
+
+	resp, err := sender.Send(NewMessage(map[string]interface{}{"key": "value"}, "1", "gone"), 0)
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if resp.Success != 1 || resp.Failure != 1 || resp.Results[0].MessageID != "id-1" {
+		t.Fatalf("response %+v, want one success and one failure", resp)
+	}
+	if msgs := sim.Messages(); len(msgs) != 1 || msgs[0].Data["key"] != "value" {
+		t.Fatalf("recorded messages %+v, want the message sent", msgs)
+	}
+}
+
+func TestNewClientOrSimulator(t *testing.T) {
+	t.Setenv(SimulateEnv, "")
+	sender, err := NewClientOrSimulator(GcmSendEndpoint, "key")
+	if err != nil || sender.Simulator != nil {
+		t.Fatalf("sender %+v, error %v, want a real client without SimulateEnv", sender, err)
+	}
+
+	t.Setenv(SimulateEnv, "1")
+	sender, err = NewClientOrSimulator("", "")
+	if err != nil || sender.Simulator == nil {
+		t.Fatalf("sender %+v, error %v, want a simulator with SimulateEnv", sender, err)
+	}
+	if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if len(sender.Simulator.Messages()) != 1 {
+		t.Fatal("the message should have been sent to the simulator")
+	}
+
+	// Senders built otherwise ignore the environment.
+	plain := &Sender{}
+	if _, err := plain.SendNoRetry(NewMessage(nil, "1")); err == nil {
+		t.Fatal("test should fail for a sender without an API key")
+	}
+}
+
+func TestSimulatorRedact(t *testing.T) {
+	var logged *Message
+	sim := &Simulator{Redact: RedactValues, OnMessage: func(msg *Message) { logged = msg }}
+	sender := &Sender{Simulator: sim}
+
+	msg := NewCombinedMessage(&Notification{Title: "Hello Alice", ClickAction: "OPEN"},
+		map[string]interface{}{"order": "1234"}, "0123456789abcdef")
+	if _, err := sender.SendNoRetry(msg); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if logged.Data["order"] != "[redacted]" || logged.Notification.Title != "[redacted]" ||
+		logged.Notification.ClickAction != "OPEN" || logged.RegistrationIDs[0] != "01234567..." {
+		t.Fatalf("logged message %+v, want the content redacted", logged)
+	}
+	if msgs := sim.Messages(); msgs[0].Data["order"] != "1234" {
+		t.Fatalf("recorded message %+v, want it unredacted", msgs[0])
+	}
+	if msg.Data["order"] != "1234" || msg.Notification.Title != "Hello Alice" {
+		t.Fatal("redaction must not modify the message")
+	}
+}
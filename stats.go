@@ -0,0 +1,325 @@
+package gcm
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats holds cumulative counters of the requests a Sender has made since
+// it was created. Counts of successes and failures are per registration
+// ID and per attempt, so a device that was retried twice before the
+// message got through counts as two failures and one success.
+type Stats struct {
+	// Requests is the number of HTTP requests made to the GCM server,
+	// including retries.
+	Requests int64
+
+	// RequestErrors is the number of requests that failed as a whole,
+	// because of a network error or a non-200 status code.
+	RequestErrors int64
+
+	// Retries is the number of requests made to retry devices whose
+	// previous attempt failed with a recoverable error.
+	Retries int64
+
+	// Successes and Failures are the number of per-device results
+	// reporting success and failure.
+	Successes int64
+	Failures  int64
+
+	// FailuresByCode breaks Failures down by error code.
+	FailuresByCode map[ErrorCode]int64
+
+	// BytesSent is the total size of the request bodies sent.
+	BytesSent int64
+
+	// BytesSentByTenant breaks BytesSent down by the tenant set with
+	// WithTenant on the context of the send. Requests without a tenant
+	// are not included. Usage over a time window is the difference of
+	// two snapshots.
+	BytesSentByTenant map[string]int64
+
+	// AverageLatency is the mean time from sending a request until its
+	// response was decoded, or the request failed.
+	AverageLatency time.Duration
+
+	// ErrorBudget is the state of the sender's SLO. It is the zero value
+	// if the sender has none.
+	ErrorBudget ErrorBudget
+
+	// Endpoints and Tenants hold smoothed estimates of the outcome of
+	// requests per URL, and per tenant set with WithTenant.
+	Endpoints map[string]Estimate
+	Tenants   map[string]Estimate
+}
+
+// defaultSmoothing is the weight of the latest request in an Estimate
+// when the sender's Smoothing is zero.
+const defaultSmoothing = 0.1
+
+// Estimate is an exponentially weighted moving average of the outcome of
+// requests. It follows lasting changes within a few dozen requests, while
+// single failures barely move it, which makes it a better signal for
+// failover and pacing decisions than the last error. A request counts as
+// a success unless it is bad under the definition of SLO.
+type Estimate struct {
+	SuccessRate float64
+	Latency     time.Duration
+
+	// Requests is the number of requests the estimate is based on.
+	Requests int64
+}
+
+// update accounts for a request, weighting it by alpha.
+func (e *Estimate) update(alpha float64, bad bool, latency time.Duration) {
+	v := 1.0
+	if bad {
+		v = 0
+	}
+	if e.Requests == 0 {
+		e.SuccessRate, e.Latency = v, latency
+	} else {
+		e.SuccessRate += alpha * (v - e.SuccessRate)
+		e.Latency += time.Duration(alpha * float64(latency-e.Latency))
+	}
+	e.Requests++
+}
+
+// sloBuckets is the number of buckets the window of an SLO is divided
+// into. Requests leave the window one bucket at a time.
+const sloBuckets = 60
+
+// SLO is a service level objective for the share of a Sender's requests
+// that succeed, measured over a rolling window. A request is bad if it
+// failed as a whole or any of its results is Unavailable or
+// InternalServerError, the errors that indicate a problem of the server
+// rather than of the message or device.
+type SLO struct {
+	// Target is the share of requests that must be good, e.g. 0.999.
+	// The SLO is disabled unless it is between 0 and 1.
+	Target float64
+
+	// Window is the period the success rate is measured over. If zero,
+	// one hour is used.
+	Window time.Duration
+}
+
+// ErrorBudget is how much of the error budget of an SLO is left.
+type ErrorBudget struct {
+	// Target is the SLO's target.
+	Target float64
+
+	// Requests and BadRequests are the number of requests and bad
+	// requests within the window.
+	Requests    int64
+	BadRequests int64
+
+	// SuccessRate is the share of good requests within the window, or 1
+	// if there were none.
+	SuccessRate float64
+
+	// Remaining is the share of the error budget, the bad requests the
+	// target allows, that has not been used up. It is 1 if there were no
+	// bad requests and negative once the SLO is violated.
+	Remaining float64
+}
+
+// enabled reports whether the SLO has a valid target.
+func (slo SLO) enabled() bool {
+	return slo.Target > 0 && slo.Target < 1
+}
+
+// bucketWidth returns the width of a bucket of the SLO's window.
+func (slo SLO) bucketWidth() time.Duration {
+	window := slo.Window
+	if window <= 0 {
+		window = time.Hour
+	}
+	if width := window / sloBuckets; width > 0 {
+		return width
+	}
+	return 1
+}
+
+// bucketIndex returns the index of the bucket of the SLO's window that
+// time at falls into, which is negative for times before 1970.
+func (slo SLO) bucketIndex(at time.Time) int64 {
+	return at.UnixNano() / int64(slo.bucketWidth())
+}
+
+// bucketPosition returns the position in senderStats.buckets of the
+// bucket with the given index.
+func bucketPosition(index int64) int64 {
+	return (index%sloBuckets + sloBuckets) % sloBuckets
+}
+
+// sloBucket counts the requests of one bucket of an SLO's window.
+type sloBucket struct {
+	index    int64
+	requests int64
+	bad      int64
+}
+
+// Stats returns a snapshot of the sender's statistics. It is safe to call
+// concurrently with sends.
+func (s *Sender) Stats() Stats {
+	return s.stats.snapshot(s.SLO, now(s.Clock))
+}
+
+// senderStats accumulates the statistics of a Sender. The zero value is
+// ready to use.
+type senderStats struct {
+	mu           sync.Mutex
+	stats        Stats
+	totalLatency time.Duration
+	buckets      [sloBuckets]sloBucket
+}
+
+// request describes a request for senderStats.record.
+type request struct {
+	// bytes is the size of the body, and at the time the request was
+	// made.
+	bytes   int
+	latency time.Duration
+	at      time.Time
+	resp    *Response
+	err     error
+
+	// endpoint is the URL, and tenant the tenant or empty.
+	endpoint string
+	tenant   string
+}
+
+// record accounts for a single request, counts it towards slo and
+// updates the estimates with weight alpha.
+func (st *senderStats) record(r request, slo SLO, alpha float64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.stats.Requests++
+	st.stats.BytesSent += int64(r.bytes)
+	if r.tenant != "" {
+		if st.stats.BytesSentByTenant == nil {
+			st.stats.BytesSentByTenant = make(map[string]int64)
+		}
+		st.stats.BytesSentByTenant[r.tenant] += int64(r.bytes)
+	}
+	st.totalLatency += r.latency
+	if r.err != nil {
+		st.stats.RequestErrors++
+		st.observe(slo, r.at, true)
+		st.estimate(r, alpha, true)
+		return
+	}
+
+	bad := false
+	for _, result := range r.resp.Results {
+		if result.Error == "" {
+			st.stats.Successes++
+			continue
+		}
+		if code := result.ErrorCode(); code == ErrorUnavailable || code == ErrorInternalServerError {
+			bad = true
+		}
+		st.stats.Failures++
+		if st.stats.FailuresByCode == nil {
+			st.stats.FailuresByCode = make(map[ErrorCode]int64)
+		}
+		st.stats.FailuresByCode[result.ErrorCode()]++
+	}
+	st.observe(slo, r.at, bad)
+	st.estimate(r, alpha, bad)
+}
+
+// estimate updates the estimates of the endpoint and tenant of r. st.mu
+// must be held.
+func (st *senderStats) estimate(r request, alpha float64, bad bool) {
+	if st.stats.Endpoints == nil {
+		st.stats.Endpoints = make(map[string]Estimate)
+	}
+	e := st.stats.Endpoints[r.endpoint]
+	e.update(alpha, bad, r.latency)
+	st.stats.Endpoints[r.endpoint] = e
+
+	if r.tenant != "" {
+		if st.stats.Tenants == nil {
+			st.stats.Tenants = make(map[string]Estimate)
+		}
+		e := st.stats.Tenants[r.tenant]
+		e.update(alpha, bad, r.latency)
+		st.stats.Tenants[r.tenant] = e
+	}
+}
+
+// observe counts a request made at time at towards slo. st.mu must be
+// held.
+func (st *senderStats) observe(slo SLO, at time.Time, bad bool) {
+	if !slo.enabled() {
+		return
+	}
+	index := slo.bucketIndex(at)
+	b := &st.buckets[bucketPosition(index)]
+	if b.index != index {
+		*b = sloBucket{index: index}
+	}
+	b.requests++
+	if bad {
+		b.bad++
+	}
+}
+
+// budget returns the error budget of slo at time at. st.mu must be held.
+func (st *senderStats) budget(slo SLO, at time.Time) ErrorBudget {
+	if !slo.enabled() {
+		return ErrorBudget{}
+	}
+	budget := ErrorBudget{Target: slo.Target, SuccessRate: 1, Remaining: 1}
+	index := slo.bucketIndex(at)
+	for i := index - sloBuckets + 1; i <= index; i++ {
+		if b := st.buckets[bucketPosition(i)]; b.index == i {
+			budget.Requests += b.requests
+			budget.BadRequests += b.bad
+		}
+	}
+	if budget.Requests > 0 {
+		badRate := float64(budget.BadRequests) / float64(budget.Requests)
+		budget.SuccessRate = 1 - badRate
+		budget.Remaining = 1 - badRate/(1-slo.Target)
+	}
+	return budget
+}
+
+// retry accounts for a retry attempt.
+func (st *senderStats) retry() {
+	st.mu.Lock()
+	st.stats.Retries++
+	st.mu.Unlock()
+}
+
+func (st *senderStats) snapshot(slo SLO, at time.Time) Stats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	stats := st.stats
+	stats.ErrorBudget = st.budget(slo, at)
+	if st.stats.Requests > 0 {
+		stats.AverageLatency = st.totalLatency / time.Duration(st.stats.Requests)
+	}
+	stats.FailuresByCode = make(map[ErrorCode]int64, len(st.stats.FailuresByCode))
+	for code, n := range st.stats.FailuresByCode {
+		stats.FailuresByCode[code] = n
+	}
+	stats.BytesSentByTenant = make(map[string]int64, len(st.stats.BytesSentByTenant))
+	for tenant, n := range st.stats.BytesSentByTenant {
+		stats.BytesSentByTenant[tenant] = n
+	}
+	stats.Endpoints = make(map[string]Estimate, len(st.stats.Endpoints))
+	for endpoint, e := range st.stats.Endpoints {
+		stats.Endpoints[endpoint] = e
+	}
+	stats.Tenants = make(map[string]Estimate, len(st.stats.Tenants))
+	for tenant, e := range st.stats.Tenants {
+		stats.Tenants[tenant] = e
+	}
+	return stats
+}
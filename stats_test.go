@@ -0,0 +1,136 @@
+package gcm
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	server := startTestServer(t, []*testResponse{
+		{Response: &Response{Success: 1, Failure: 2, Results: []Result{
+			{MessageID: "a"}, {Error: "Unavailable"}, {Error: "NotRegistered"},
+		}}},
+		{Response: &Response{Success: 1, Results: []Result{{MessageID: "b"}}}},
+		{StatusCode: http.StatusInternalServerError},
+	})
+	defer server.Close()
+
+	sender := &Sender{ApiKey: "test"}
+	if _, err := sender.Send(NewMessage(nil, "1", "2", "3"), 1); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if _, err := sender.SendNoRetry(NewMessage(nil, "4")); err == nil {
+		t.Fatal("expect to be failed")
+	}
+
+	stats := sender.Stats()
+	if stats.Requests != 3 || stats.RequestErrors != 1 || stats.Retries != 1 {
+		t.Fatalf("requests %d, errors %d, retries %d, want 3, 1, 1",
+			stats.Requests, stats.RequestErrors, stats.Retries)
+	}
+	if stats.Successes != 2 || stats.Failures != 2 {
+		t.Fatalf("successes %d, failures %d, want 2, 2", stats.Successes, stats.Failures)
+	}
+	if stats.FailuresByCode[ErrorUnavailable] != 1 || stats.FailuresByCode[ErrorNotRegistered] != 1 {
+		t.Fatalf("failures by code %v", stats.FailuresByCode)
+	}
+	if stats.BytesSent == 0 || stats.AverageLatency == 0 {
+		t.Fatalf("bytes sent %d, average latency %s, want non-zero", stats.BytesSent, stats.AverageLatency)
+	}
+}
+
+func TestStatsErrorBudget(t *testing.T) {
+	server := startTestServer(t, []*testResponse{
+		{Response: &Response{Failure: 1, Results: []Result{{Error: "Unavailable"}}}},
+		{Response: &Response{Failure: 1, Results: []Result{{Error: "NotRegistered"}}}},
+		{Response: &Response{Success: 1, Results: []Result{{MessageID: "a"}}}},
+		{Response: &Response{Success: 1, Results: []Result{{MessageID: "b"}}}},
+	})
+	defer server.Close()
+
+	sender := &Sender{ApiKey: "test"}
+	if budget := sender.Stats().ErrorBudget; budget != (ErrorBudget{}) {
+		t.Fatalf("error budget %+v without an SLO, want the zero value", budget)
+	}
+
+	sender.SLO = SLO{Target: 0.5, Window: time.Minute}
+	if budget := sender.Stats().ErrorBudget; budget.Remaining != 1 || budget.SuccessRate != 1 {
+		t.Fatalf("error budget %+v before any request, want it untouched", budget)
+	}
+	for i := 0; i < 4; i++ {
+		sender.SendNoRetry(NewMessage(nil, "1"))
+	}
+	budget := sender.Stats().ErrorBudget
+	if budget.Requests != 4 || budget.BadRequests != 1 || budget.SuccessRate != 0.75 || budget.Remaining != 0.5 {
+		t.Fatalf("error budget %+v, want 1 of 4 requests bad and half the budget left", budget)
+	}
+}
+
+func TestStatsBytesSentByTenant(t *testing.T) {
+	sender := &Sender{Simulator: new(Simulator)}
+	for _, tenant := range []string{"shop", "shop", "news", ""} {
+		ctx := context.Background()
+		if tenant != "" {
+			ctx = WithTenant(ctx, tenant)
+		}
+		if _, err := sender.SendContext(ctx, NewMessage(nil, "1"), 0); err != nil {
+			t.Fatalf("expect to be success: %s", err)
+		}
+	}
+
+	stats := sender.Stats()
+	shop, news := stats.BytesSentByTenant["shop"], stats.BytesSentByTenant["news"]
+	if len(stats.BytesSentByTenant) != 2 || shop != 2*news || shop+news >= stats.BytesSent {
+		t.Fatalf("bytes sent by tenant %v of %d, want shop twice news", stats.BytesSentByTenant, stats.BytesSent)
+	}
+}
+
+func TestStatsEstimates(t *testing.T) {
+	server := startTestServer(t, []*testResponse{
+		{Response: &Response{Success: 1, Results: []Result{{MessageID: "a"}}}},
+		{StatusCode: http.StatusServiceUnavailable},
+		{Response: &Response{Failure: 1, Results: []Result{{Error: "NotRegistered"}}}},
+	})
+	defer server.Close()
+
+	sender := &Sender{ApiKey: "test", Smoothing: 0.5}
+	ctx := WithTenant(context.Background(), "shop")
+	for i := 0; i < 3; i++ {
+		sender.SendContext(ctx, NewMessage(nil, "1"), 0)
+	}
+
+	stats := sender.Stats()
+	endpoint := stats.Endpoints[server.URL]
+	// 1, then 1 + 0.5*(0-1) = 0.5, then 0.5 + 0.5*(1-0.5) = 0.75, since
+	// NotRegistered is not the server's fault.
+	if endpoint.Requests != 3 || endpoint.SuccessRate != 0.75 || endpoint.Latency <= 0 {
+		t.Fatalf("endpoint estimate %+v, want a success rate of 0.75 over 3 requests", endpoint)
+	}
+	if stats.Tenants["shop"] != endpoint {
+		t.Fatalf("tenant estimate %+v, want %+v", stats.Tenants["shop"], endpoint)
+	}
+}
+
+func TestStatsErrorBudgetBefore1970(t *testing.T) {
+	server := startTestServer(t, []*testResponse{
+		{Response: &Response{Success: 1, Results: []Result{{MessageID: "a"}}}},
+		{Response: &Response{Failure: 1, Results: []Result{{Error: "Unavailable"}}}},
+	})
+	defer server.Close()
+
+	for i, clock := range []time.Time{{}, time.Date(1969, 12, 31, 23, 59, 30, 0, time.UTC)} {
+		clock := clock
+		sender := &Sender{
+			ApiKey: "test",
+			SLO:    SLO{Target: 0.5, Window: time.Minute},
+			Clock:  ClockFunc(func() time.Time { return clock }),
+		}
+		sender.SendNoRetry(NewMessage(nil, "1"))
+		budget := sender.Stats().ErrorBudget
+		if budget.Requests != 1 {
+			t.Fatalf("#%d error budget %+v, want 1 request", i, budget)
+		}
+	}
+}
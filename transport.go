@@ -0,0 +1,356 @@
+package gcm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultDialTimeout and defaultKeepAlive match the dialer of
+	// http.DefaultTransport.
+	defaultDialTimeout = 30 * time.Second
+	defaultKeepAlive   = 30 * time.Second
+
+	// defaultResolverTTL is how long a CachingResolver keeps addresses
+	// when its TTL field is zero.
+	defaultResolverTTL = time.Minute
+)
+
+// Resolver looks up the IP addresses of a host. *net.Resolver implements
+// it, so a resolver talking to a specific DNS server can be plugged in
+// directly.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// TransportOptions configures the transport returned by NewTransport.
+// The zero value yields the settings of http.DefaultTransport.
+type TransportOptions struct {
+	// DialContext, if not nil, is used to open network connections
+	// instead of a net.Dialer.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Resolver, if not nil, is used to resolve host names before
+	// dialing instead of the system resolver. Wrap it in a
+	// CachingResolver to avoid a lookup for every new connection.
+	Resolver Resolver
+
+	// DialTimeout limits how long establishing a TCP connection may
+	// take. If zero, 30 seconds is used. It is ignored if DialContext
+	// is set.
+	DialTimeout time.Duration
+
+	// TLSHandshakeTimeout limits how long the TLS handshake may take.
+	// If zero, the value of http.DefaultTransport is used.
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout limits how long to wait for the server's
+	// response headers after the request has been written. It does not
+	// limit reading the response body, so large multicast responses are
+	// not cut short. If zero, there is no limit.
+	ResponseHeaderTimeout time.Duration
+
+	// UnixSocket, if not empty, is the path of a unix-domain socket all
+	// connections are made to, e.g. that of a sidecar proxy, regardless
+	// of the host of the Sender's URL. Resolver is not used then.
+	UnixSocket string
+}
+
+// NewTransport returns an *http.Transport configured by opts, starting
+// from a copy of http.DefaultTransport. Its timeouts apply to the phases
+// of each request separately, while the Timeout of the http.Client caps
+// the request as a whole. Use it to build the Sender's client as follows:
+//
+//	transport := gcm.NewTransport(gcm.TransportOptions{
+//		Resolver: &gcm.CachingResolver{TTL: 5 * time.Minute},
+//	})
+//	sender := &gcm.Sender{ApiKey: key, Http: &http.Client{Transport: transport}}
+func NewTransport(opts TransportOptions) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	dial := opts.DialContext
+	if dial == nil {
+		dialer := &net.Dialer{
+			Timeout:   defaultDialTimeout,
+			KeepAlive: defaultKeepAlive,
+		}
+		if opts.DialTimeout != 0 {
+			dialer.Timeout = opts.DialTimeout
+		}
+		dial = dialer.DialContext
+	}
+	if opts.UnixSocket != "" {
+		dial = unixDialer(opts.UnixSocket, dial)
+	} else if opts.Resolver != nil {
+		dial = resolvingDialer(opts.Resolver, dial)
+	}
+	t.DialContext = dial
+
+	if opts.TLSHandshakeTimeout != 0 {
+		t.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+	}
+	t.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	return t
+}
+
+// unixDialer returns a dial function that connects to the unix-domain
+// socket at path, whatever address is asked for.
+func unixDialer(path string, dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dial(ctx, "unix", path)
+	}
+}
+
+// NewHandlerTransport returns an http.RoundTripper that serves requests
+// with h in-process instead of sending them over the network, e.g. for
+// hermetic tests or an embedded proxy:
+//
+//	sender := &gcm.Sender{ApiKey: key, Http: &http.Client{Transport: gcm.NewHandlerTransport(h)}}
+//
+// h runs on a goroutine of its own, so that a request can be canceled
+// while it runs. A panic in h does not crash the process but fails the
+// request with an error describing the panic.
+func NewHandlerTransport(h http.Handler) http.RoundTripper {
+	return handlerTransport{h}
+}
+
+type handlerTransport struct {
+	h http.Handler
+}
+
+// RoundTrip implements http.RoundTripper. It gives up as soon as the
+// request's context is done; the handler, which sees the same context,
+// then runs to completion in the background. The request body is closed
+// once the handler returns. A panic in the handler is returned as an
+// error.
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if err := ctx.Err(); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	w := &handlerResponseWriter{header: make(http.Header)}
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				done <- fmt.Errorf("handler panicked: %v", v)
+			}
+			close(done)
+		}()
+		if req.Body != nil {
+			defer req.Body.Close()
+		}
+		t.h.ServeHTTP(w, req)
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w.response(req), nil
+}
+
+// handlerResponseWriter is the http.ResponseWriter a handlerTransport
+// passes to its handler. It buffers the response in memory.
+type handlerResponseWriter struct {
+	header      http.Header
+	code        int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (w *handlerResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *handlerResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.code, w.wroteHeader = code, true
+}
+
+func (w *handlerResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// response returns the response the handler wrote, as an answer to req.
+func (w *handlerResponseWriter) response(req *http.Request) *http.Response {
+	w.WriteHeader(http.StatusOK)
+	if w.header.Get("Content-Type") == "" && w.body.Len() > 0 {
+		w.header.Set("Content-Type", http.DetectContentType(w.body.Bytes()))
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", w.code, http.StatusText(w.code)),
+		StatusCode:    w.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          io.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}
+}
+
+// resolvingDialer returns a dial function that resolves the host of the
+// address with r and then dials the resulting IP addresses in order until
+// one of them succeeds.
+func resolvingDialer(r Resolver, dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		ips, err := r.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		} else if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+
+		for _, ip := range ips {
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// CachingResolver is a Resolver that caches the addresses returned by
+// another Resolver for a fixed amount of time. Failed lookups are not
+// cached. The zero value is ready to use and wraps net.DefaultResolver.
+type CachingResolver struct {
+	// Resolver performs the actual lookups. If nil, net.DefaultResolver
+	// is used.
+	Resolver Resolver
+
+	// TTL is how long addresses are cached. If zero, one minute is used.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]resolverEntry
+}
+
+type resolverEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// LookupHost returns the cached addresses of host, looking them up again
+// if they are missing or expired.
+func (r *CachingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	now := time.Now()
+	r.mu.Lock()
+	entry, ok := r.entries[host]
+	r.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	var resolver Resolver = net.DefaultResolver
+	if r.Resolver != nil {
+		resolver = r.Resolver
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	} else if len(addrs) == 0 {
+		return nil, errors.New("no addresses found for " + host)
+	}
+
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = defaultResolverTTL
+	}
+	r.mu.Lock()
+	if r.entries == nil {
+		r.entries = make(map[string]resolverEntry)
+	}
+	r.entries[host] = resolverEntry{addrs: addrs, expires: now.Add(ttl)}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// idleReader wraps a response body and closes it if no data arrives for
+// longer than a timeout, which unblocks a pending Read.
+type idleReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	expired int32
+}
+
+func newIdleReader(body io.ReadCloser, timeout time.Duration) *idleReader {
+	r := &idleReader{body: body, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&r.expired, 1)
+		body.Close()
+	})
+	return r
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if atomic.LoadInt32(&r.expired) == 1 {
+		return n, fmt.Errorf("no response data received for %s", r.timeout)
+	}
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// stop releases the timer once the body has been read.
+func (r *idleReader) stop() {
+	r.timer.Stop()
+}
+
+// limitReader reads at most limit bytes from r, and fails with a
+// *ResponseTooLargeError if there are more. Unlike io.LimitReader, it
+// does not silently truncate, which would make a decoder report a
+// misleading syntax error.
+type limitReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	if lr.n <= 0 {
+		// A body of exactly limit bytes is fine if it ends here.
+		var b [1]byte
+		if n, err := lr.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, &ResponseTooLargeError{Limit: lr.limit}
+	}
+	if int64(len(p)) > lr.n {
+		p = p[:lr.n]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	return n, err
+}
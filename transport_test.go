@@ -0,0 +1,253 @@
+package gcm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	addrs   map[string][]string
+	lookups int
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lookups++
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestCachingResolver(t *testing.T) {
+	fake := &fakeResolver{addrs: map[string][]string{"gcm.test": {"127.0.0.1"}}}
+	r := &CachingResolver{Resolver: fake}
+
+	for i := 0; i < 3; i++ {
+		addrs, err := r.LookupHost(context.Background(), "gcm.test")
+		if err != nil {
+			t.Fatalf("#%d failed to look up: %s", i, err)
+		}
+		if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+			t.Fatalf("#%d addresses %v, want [127.0.0.1]", i, addrs)
+		}
+	}
+	if fake.lookups != 1 {
+		t.Fatalf("resolver was called %d times, want 1", fake.lookups)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupHost(context.Background(), "unknown.test"); err == nil {
+			t.Fatal("test should fail when the host does not exist")
+		}
+	}
+	if fake.lookups != 3 {
+		t.Fatalf("resolver was called %d times, want failed lookups not to be cached", fake.lookups)
+	}
+}
+
+func TestNewTransportResolver(t *testing.T) {
+	server := startTestServer(t, []*testResponse{
+		{Response: &Response{Success: 1, Results: []Result{{MessageID: "id"}}}},
+	})
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+	fake := &fakeResolver{addrs: map[string][]string{"gcm.test": {"127.0.0.1"}}}
+	transport := NewTransport(TransportOptions{Resolver: fake})
+
+	sender := &Sender{
+		ApiKey: "test",
+		URL:    "http://gcm.test:" + port,
+		Http:   &http.Client{Transport: transport},
+	}
+	if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if fake.lookups != 1 {
+		t.Fatalf("resolver was called %d times, want 1", fake.lookups)
+	}
+}
+
+func TestNewTransportUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gcm.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets are not supported: %s", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&Response{Success: 1, Results: []Result{{MessageID: "id"}}})
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	sender := &Sender{
+		ApiKey: "test",
+		URL:    "http://sidecar/send",
+		Http:   &http.Client{Transport: NewTransport(TransportOptions{UnixSocket: path})},
+	}
+	if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+}
+
+func TestNewHandlerTransport(t *testing.T) {
+	var paths []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		json.NewEncoder(w).Encode(&Response{Success: 1, Results: []Result{{MessageID: "id"}}})
+	})
+
+	sender := &Sender{
+		ApiKey: "test",
+		URL:    "http://in-process/send",
+		Http:   &http.Client{Transport: NewHandlerTransport(handler)},
+	}
+	resp, err := sender.SendNoRetry(NewMessage(nil, "1"))
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if resp.Success != 1 || len(paths) != 1 || paths[0] != "/send" {
+		t.Fatalf("response %+v after requests to %v, want one success at /send", resp, paths)
+	}
+}
+
+// closeRecorder is a request body that records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestHandlerTransportCancel(t *testing.T) {
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	body := &closeRecorder{Reader: strings.NewReader("{}"), closed: make(chan struct{})}
+	req, _ := http.NewRequestWithContext(ctx, "POST", "http://in-process/send", body)
+	if _, err := NewHandlerTransport(handler).RoundTrip(req); err != context.DeadlineExceeded {
+		t.Fatalf("RoundTrip returned %v, want the context's error", err)
+	}
+
+	release <- struct{}{}
+	select {
+	case <-body.closed:
+	case <-time.After(time.Second):
+		t.Fatal("the request body was not closed")
+	}
+}
+
+func TestHandlerTransportPanic(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	sender := &Sender{
+		ApiKey: "test",
+		URL:    "http://in-process/send",
+		Http:   &http.Client{Transport: NewHandlerTransport(handler)},
+	}
+	if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("send returned %v, want the handler's panic", err)
+	}
+}
+
+func TestNewTransportResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	transport := NewTransport(TransportOptions{ResponseHeaderTimeout: 50 * time.Millisecond})
+	if transport.TLSHandshakeTimeout != http.DefaultTransport.(*http.Transport).TLSHandshakeTimeout {
+		t.Fatalf("TLSHandshakeTimeout %s, want the default", transport.TLSHandshakeTimeout)
+	}
+
+	sender := &Sender{ApiKey: "test", URL: server.URL, Http: &http.Client{Transport: transport}}
+	if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err == nil {
+		t.Fatal("test should fail when the server does not respond in time")
+	}
+}
+
+func TestReadIdleTimeout(t *testing.T) {
+	cases := []struct {
+		gap     time.Duration
+		success bool
+	}{
+		{60 * time.Millisecond, true},
+		{500 * time.Millisecond, false},
+	}
+
+	for i, tc := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := `{"success":1,"results":[{"message_id":"id"}]}`
+			for j := 0; j < len(body); j += 10 {
+				end := j + 10
+				if end > len(body) {
+					end = len(body)
+				}
+				w.Write([]byte(body[j:end]))
+				w.(http.Flusher).Flush()
+				select {
+				case <-time.After(tc.gap):
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}))
+
+		sender := &Sender{ApiKey: "test", URL: server.URL, ReadIdleTimeout: 100 * time.Millisecond}
+		_, err := sender.SendNoRetry(NewMessage(nil, "1"))
+		if tc.success && err != nil {
+			t.Fatalf("#%d expect to be success: %s", i, err)
+		} else if !tc.success && err == nil {
+			t.Fatalf("#%d expect to be failed", i)
+		}
+		server.Close()
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	results := make([]Result, 1000)
+	for i := range results {
+		results[i].MessageID = "0:1234567890"
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&Response{Success: len(results), Results: results})
+	}))
+	defer server.Close()
+
+	sender := &Sender{ApiKey: "test", URL: server.URL}
+	if _, err := sender.SendNoRetry(NewMessage(nil, "1")); err != nil {
+		t.Fatalf("expect to be success with the default limit: %s", err)
+	}
+
+	sender.MaxResponseBytes = 1024
+	_, err := sender.SendNoRetry(NewMessage(nil, "1"))
+	var tooLarge *ResponseTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Limit != 1024 {
+		t.Fatalf("error %v, want a ResponseTooLargeError", err)
+	}
+}
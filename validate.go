@@ -0,0 +1,117 @@
+package gcm
+
+import (
+	"context"
+	"errors"
+)
+
+// TokenStatus classifies a registration ID checked by a TokenValidator.
+type TokenStatus string
+
+const (
+	// TokenValid means a message to the registration ID would be
+	// accepted.
+	TokenValid TokenStatus = "valid"
+
+	// TokenUnregistered means the application was uninstalled or the
+	// registration ID expired. It should be removed.
+	TokenUnregistered TokenStatus = "unregistered"
+
+	// TokenInvalid means the registration ID is malformed or belongs to
+	// a different sender. It should be removed.
+	TokenInvalid TokenStatus = "invalid"
+
+	// TokenUnknown means the status could not be determined, e.g.
+	// because the server stayed unavailable. It should be checked again
+	// later.
+	TokenUnknown TokenStatus = "unknown"
+)
+
+// tokenStatus returns the status a result indicates.
+func tokenStatus(result Result) TokenStatus {
+	if result.MessageID != "" {
+		return TokenValid
+	}
+	switch result.ErrorCode() {
+	case ErrorNotRegistered:
+		return TokenUnregistered
+	case ErrorInvalidRegistration, ErrorMismatchSenderID, ErrorMissingRegistration:
+		return TokenInvalid
+	}
+	return TokenUnknown
+}
+
+// TokenReport summarizes a validation run.
+type TokenReport struct {
+	Valid        int `json:"valid"`
+	Unregistered int `json:"unregistered"`
+	Invalid      int `json:"invalid"`
+	Unknown      int `json:"unknown"`
+
+	// CanonicalIDs is the number of valid registration IDs that have
+	// been replaced by a newer one.
+	CanonicalIDs int `json:"canonical_ids"`
+}
+
+// TokenValidator checks a token database for stale registration IDs by
+// sending dry-run messages, which the server validates without delivering
+// them to devices. It is meant for periodic hygiene of large databases.
+type TokenValidator struct {
+	// Sender sends the dry-run messages.
+	Sender *Sender
+
+	// BatchSize is the number of registration IDs checked per request.
+	// If zero, or greater than 1000, 1000 is used.
+	BatchSize int
+
+	// Retries is the number of retries for registration IDs that fail
+	// with a recoverable error.
+	Retries int
+
+	// OnToken, if not nil, is called with the status of every checked
+	// registration ID, its error, and its canonical replacement if the
+	// server reported one.
+	OnToken func(regID string, status TokenStatus, code ErrorCode, canonicalID string)
+}
+
+// Validate checks every registration ID of src and returns a summary. If
+// ctx is canceled, it gives up on the current batch and returns ctx.Err()
+// together with the summary of the batches checked so far.
+func (v *TokenValidator) Validate(ctx context.Context, src RecipientSource) (TokenReport, error) {
+	if src == nil {
+		return TokenReport{}, errors.New("the recipient source must not be nil")
+	}
+
+	var report TokenReport
+	c := &Campaign{
+		ID:        "validate",
+		Sender:    v.Sender,
+		Message:   &Message{DryRun: true},
+		Source:    src,
+		ChunkSize: v.BatchSize,
+		Retries:   v.Retries,
+		OnChunk: func(_ string, regIDs []string, resp *Response) {
+			for i, result := range resp.Results {
+				status := tokenStatus(result)
+				switch status {
+				case TokenValid:
+					report.Valid++
+					if result.RegistrationID != "" {
+						report.CanonicalIDs++
+					}
+				case TokenUnregistered:
+					report.Unregistered++
+				case TokenInvalid:
+					report.Invalid++
+				default:
+					report.Unknown++
+				}
+				if v.OnToken != nil {
+					v.OnToken(regIDs[i], status, result.ErrorCode(), result.RegistrationID)
+				}
+			}
+		},
+	}
+	_, err := c.Run(ctx)
+	return report, err
+}
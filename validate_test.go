@@ -0,0 +1,60 @@
+package gcm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenValidator(t *testing.T) {
+	errs := map[string]Result{
+		"gone":  {Error: "NotRegistered"},
+		"bad":   {Error: "InvalidRegistration"},
+		"other": {Error: "MismatchSenderId"},
+		"busy":  {Error: "Unavailable"},
+		"old":   {MessageID: "id", RegistrationID: "new"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Fatalf("failed to decode request: %s", err)
+		}
+		if !msg.DryRun {
+			t.Fatal("validation messages must be dry runs")
+		}
+		resp := &Response{Results: make([]Result, len(msg.RegistrationIDs))}
+		for i, regID := range msg.RegistrationIDs {
+			result, ok := errs[regID]
+			if !ok {
+				result = Result{MessageID: "id"}
+			}
+			resp.Results[i] = result
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	statuses := make(map[string]TokenStatus)
+	v := &TokenValidator{
+		Sender:    &Sender{ApiKey: "test", URL: server.URL},
+		BatchSize: 3,
+		OnToken: func(regID string, status TokenStatus, code ErrorCode, canonicalID string) {
+			statuses[regID] = status
+		},
+	}
+	src := SliceSource([]string{"ok1", "gone", "bad", "other", "busy", "old", "ok2"})
+	report, err := v.Validate(context.Background(), src)
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+
+	want := TokenReport{Valid: 3, Unregistered: 1, Invalid: 2, Unknown: 1, CanonicalIDs: 1}
+	if report != want {
+		t.Fatalf("report %+v, want %+v", report, want)
+	}
+	if statuses["gone"] != TokenUnregistered || statuses["busy"] != TokenUnknown || statuses["ok2"] != TokenValid {
+		t.Fatalf("statuses %v", statuses)
+	}
+}
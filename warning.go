@@ -0,0 +1,160 @@
+package gcm
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// WarningCode identifies the kind of condition a Warning reports.
+type WarningCode string
+
+const (
+	// WarningUnknownField is reported when the GCM server's response
+	// contains a field this package does not decode. The field is
+	// ignored, but it usually means the server started returning data
+	// that should be supported.
+	WarningUnknownField WarningCode = "unknown_field"
+
+	// WarningResultCount is reported when the number of results in a
+	// response does not match the number of registration IDs sent, e.g.
+	// because a proxy that delivers requests at least once answered with
+	// the results of an earlier attempt as well. Count is the number of
+	// extra results, or negative for missing ones. Results are matched
+	// to registration IDs by position and extra ones are dropped; devices
+	// without a result are reported as failed without an error.
+	WarningResultCount WarningCode = "result_count"
+
+	// WarningDuplicateResult is reported when a registration ID occurs
+	// more than once in a message and a later occurrence fails after an
+	// earlier one succeeded. The success is kept. Count is the number of
+	// such results.
+	WarningDuplicateResult WarningCode = "duplicate_result"
+
+	// WarningReservedDataKey is reported for a data payload key that is
+	// reserved, such as "from" or keys starting with "google". The
+	// server rejects such messages with ErrorInvalidDataKey.
+	WarningReservedDataKey WarningCode = "reserved_data_key"
+
+	// WarningEmptyNotification is reported for a notification without a
+	// title or body, which most platforms display as a blank entry or
+	// not at all.
+	WarningEmptyNotification WarningCode = "empty_notification"
+
+	// WarningBackgroundData is reported for a message with both a
+	// notification and data but no click action. On Android, when the
+	// application is in the background, the data only reaches it as
+	// extras of the launcher activity, and only if the user taps the
+	// notification.
+	WarningBackgroundData WarningCode = "background_data"
+
+	// WarningSilentNotification is reported for a message that asks for
+	// a silent background wake-up with content_available but also carries
+	// a notification, which iOS will display to the user.
+	WarningSilentNotification WarningCode = "silent_notification"
+)
+
+// Warning describes a condition that did not prevent a message from
+// being sent but that the application server may want to know about.
+// Warnings are delivered to the Sender's OnWarning hook.
+type Warning struct {
+	Code WarningCode
+
+	// Field is the path of the field the warning is about, if any,
+	// such as "results[].new_field".
+	Field string
+
+	// Count is the number of times the condition occurred in a single
+	// request or response.
+	Count int
+}
+
+func (w Warning) String() string {
+	if w.Field == "" {
+		return string(w.Code)
+	}
+	return fmt.Sprintf("%s: %s (%d times)", w.Code, w.Field, w.Count)
+}
+
+// warn passes w to the sender's OnWarning hook, if one is set.
+func (s *Sender) warn(w Warning) {
+	if s.OnWarning != nil {
+		s.OnWarning(w)
+	}
+}
+
+// warnUnknownFields reports every field of the raw response that does not
+// map to a field of Response or Result.
+func (s *Sender) warnUnknownFields(raw []byte) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return
+	}
+
+	counts := make(map[string]int)
+	collectUnknownFields(v, reflect.TypeOf(Response{}), "", counts)
+
+	paths := make([]string, 0, len(counts))
+	for path := range counts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		s.warn(Warning{Code: WarningUnknownField, Field: path, Count: counts[path]})
+	}
+}
+
+// collectUnknownFields walks v, the generic decoding of a JSON value that
+// is expected to match t, and counts the object keys t has no field for.
+func collectUnknownFields(v interface{}, t reflect.Type, prefix string, counts map[string]int) {
+	switch t.Kind() {
+	case reflect.Ptr:
+		collectUnknownFields(v, t.Elem(), prefix, counts)
+	case reflect.Slice:
+		elems, ok := v.([]interface{})
+		if !ok {
+			return
+		}
+		for _, elem := range elems {
+			collectUnknownFields(elem, t.Elem(), prefix+"[]", counts)
+		}
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := jsonFields(t)
+		for key, value := range obj {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			field, ok := fields[key]
+			if !ok {
+				counts[path]++
+				continue
+			}
+			collectUnknownFields(value, field.Type, path, counts)
+		}
+	}
+}
+
+// jsonFields returns the fields of the struct type t keyed by the name
+// encoding/json uses for them.
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
@@ -0,0 +1,128 @@
+package gcm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUnknownFieldWarnings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"multicast_id":1,"success":2,"failure":0,"canonical_ids":0,"new_top":true,`+
+			`"results":[{"message_id":"a","extra":1},{"message_id":"b","extra":2,"other":"x"}]}`)
+	}))
+	defer server.Close()
+
+	var warnings []Warning
+	sender, err := NewClient(server.URL, "testAPIKey")
+	if err != nil {
+		t.Fatalf("Failed to setup sender client: %s", err)
+	}
+	sender.OnWarning = func(w Warning) { warnings = append(warnings, w) }
+
+	resp, err := sender.SendNoRetry(NewMessage(nil, "1", "2"))
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if resp.Success != 2 {
+		t.Fatalf("number of success %d, want 2", resp.Success)
+	}
+
+	want := []Warning{
+		{Code: WarningUnknownField, Field: "new_top", Count: 1},
+		{Code: WarningUnknownField, Field: "results[].extra", Count: 2},
+		{Code: WarningUnknownField, Field: "results[].other", Count: 1},
+	}
+	if len(warnings) != len(want) {
+		t.Fatalf("got %d warnings %v, want %v", len(warnings), warnings, want)
+	}
+	for i := range want {
+		if warnings[i] != want[i] {
+			t.Fatalf("warning #%d %v, want %v", i, warnings[i], want[i])
+		}
+	}
+}
+
+func TestSendReconcilesResults(t *testing.T) {
+	server := startTestServer(t, []*testResponse{
+		{Response: &Response{Success: 1, Failure: 1, Results: []Result{{MessageID: "a"}, {Error: "Unavailable"}}}},
+		// A replaying proxy answers the retry of "2" with the results
+		// of both attempts.
+		{Response: &Response{Success: 1, Failure: 1, Results: []Result{{MessageID: "b"}, {Error: "Unavailable"}}}},
+	})
+	defer server.Close()
+
+	var warnings []Warning
+	sender := &Sender{ApiKey: "test", OnWarning: func(w Warning) { warnings = append(warnings, w) }}
+	resp, err := sender.Send(NewMessage(nil, "1", "2"), 1)
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if resp.Success != 2 || resp.Failure != 0 {
+		t.Fatalf("success %d, failure %d, want 2, 0", resp.Success, resp.Failure)
+	}
+	if resp.Results[0].MessageID != "a" || resp.Results[1].MessageID != "b" {
+		t.Fatalf("results %+v", resp.Results)
+	}
+	if len(warnings) != 1 || warnings[0].Code != WarningResultCount || warnings[0].Count != 1 {
+		t.Fatalf("warnings %v, want one extra result", warnings)
+	}
+}
+
+func TestSendKeepsEarlierSuccess(t *testing.T) {
+	server := startTestServer(t, []*testResponse{
+		{Response: &Response{Success: 1, Failure: 2, Results: []Result{
+			{MessageID: "a"}, {Error: "Unavailable"}, {Error: "Unavailable"},
+		}}},
+		{Response: &Response{Success: 1, Results: []Result{{MessageID: "b"}}}},
+	})
+	defer server.Close()
+
+	var warnings []Warning
+	sender := &Sender{ApiKey: "test", OnWarning: func(w Warning) { warnings = append(warnings, w) }}
+	resp, err := sender.Send(NewMessage(nil, "1", "1", "2"), 1)
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if resp.Results[0].MessageID != "a" || resp.Results[2].MessageID != "b" {
+		t.Fatalf("results %+v", resp.Results)
+	}
+	if len(warnings) != 1 || warnings[0].Code != WarningDuplicateResult {
+		t.Fatalf("warnings %v, want one duplicate result", warnings)
+	}
+}
+
+func TestSendReconcilesFirstAttempt(t *testing.T) {
+	server := startTestServer(t, []*testResponse{
+		// A replaying proxy answers with the results of two attempts.
+		{Response: &Response{Success: 2, Results: []Result{{MessageID: "a"}, {MessageID: "b"}}}},
+		{Response: &Response{Success: 1, Results: []Result{{MessageID: "c"}}}},
+	})
+	defer server.Close()
+
+	var warnings []Warning
+	sender := &Sender{ApiKey: "test", OnWarning: func(w Warning) { warnings = append(warnings, w) }}
+	resp, err := sender.Send(NewMessage(nil, "1"), 0)
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if resp.Success != 1 || resp.Failure != 0 || len(resp.Results) != 1 || resp.Results[0].MessageID != "a" {
+		t.Fatalf("response %+v, want the extra result dropped", resp)
+	}
+	if len(warnings) != 1 || warnings[0].Code != WarningResultCount || warnings[0].Count != 1 {
+		t.Fatalf("warnings %v, want one extra result", warnings)
+	}
+
+	warnings = nil
+	resp, err = sender.Send(NewMessage(nil, "1", "2"), 1)
+	if err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if resp.Success != 1 || resp.Failure != 1 || len(resp.Results) != 2 || resp.Results[1] != (Result{}) {
+		t.Fatalf("response %+v, want the missing result reported as failed", resp)
+	}
+	if len(warnings) != 1 || warnings[0].Code != WarningResultCount || warnings[0].Count != -1 {
+		t.Fatalf("warnings %v, want one missing result", warnings)
+	}
+}
@@ -0,0 +1,152 @@
+package gcm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultWebhookBackoff is the delay before the first retry of a
+	// webhook when its Backoff field is zero.
+	defaultWebhookBackoff = time.Second
+
+	// defaultWebhookTimeout bounds every delivery of a webhook without a
+	// Client.
+	defaultWebhookTimeout = 10 * time.Second
+
+	// maxWebhookDrain is the number of bytes of a webhook response that
+	// are read and discarded so that the connection can be reused.
+	maxWebhookDrain = 64 << 10
+)
+
+// defaultWebhookClient is used by webhooks without a Client.
+var defaultWebhookClient = &http.Client{Timeout: defaultWebhookTimeout}
+
+// WebhookPayload is the JSON body a Webhook posts for every send.
+type WebhookPayload struct {
+	// MulticastIDs are the multicast IDs of every attempt.
+	MulticastIDs []int64 `json:"multicast_ids"`
+
+	Success      int       `json:"success"`
+	Failure      int       `json:"failure"`
+	CanonicalIDs int       `json:"canonical_ids"`
+	Outcomes     []Outcome `json:"outcomes"`
+}
+
+// Webhook is a ResultProcessor that posts the outcomes of every send to a
+// URL as a WebhookPayload, for consumers in other services. Deliveries
+// are retried with exponential backoff, and can be signed so that the
+// consumer can verify where they come from.
+//
+// Process runs synchronously within every send, including every chunk of
+// a campaign, so a slow consumer delays the sender by up to the timeout
+// of all attempts and the backoff between them.
+type Webhook struct {
+	// URL receives the POST requests.
+	URL string
+
+	// Client makes the requests. If nil, a client that gives up on every
+	// attempt after 10 seconds is used.
+	Client *http.Client
+
+	// Signer, if not nil, signs every request, typically an HMACSigner
+	// with a secret shared with the consumer.
+	Signer RequestSigner
+
+	// Retries is the number of times a delivery is retried after a
+	// network error or a status code other than 2xx. The first retry
+	// waits Backoff, one second if zero, and every further retry twice
+	// as long as the previous one.
+	Retries int
+	Backoff time.Duration
+
+	// DeadLetter, if not nil, is called with the payload of deliveries
+	// that failed every attempt, e.g. to store them for a later replay.
+	// It is also called when the outcomes cannot be determined, with a
+	// payload without them. The send then succeeds; otherwise it fails
+	// with a ProcessorError.
+	DeadLetter func(payload []byte, err error)
+}
+
+// Process implements ResultProcessor.
+func (wh *Webhook) Process(ctx context.Context, regIDs []string, resp *Response) error {
+	outcomes, oerr := Outcomes(regIDs, resp)
+	payload, err := json.Marshal(&WebhookPayload{
+		MulticastIDs: resp.MulticastIDs,
+		Success:      resp.Success,
+		Failure:      resp.Failure,
+		CanonicalIDs: resp.CanonicalIDs,
+		Outcomes:     outcomes,
+	})
+	if err != nil {
+		return err
+	} else if oerr != nil {
+		return wh.deadLetter(payload, oerr)
+	}
+
+	backoff := wh.Backoff
+	if backoff <= 0 {
+		backoff = defaultWebhookBackoff
+	}
+	for i := 0; ; i++ {
+		if err = wh.deliver(ctx, payload); err == nil {
+			return nil
+		} else if i >= wh.Retries || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return wh.deadLetter(payload, err)
+}
+
+// deadLetter passes a payload that could not be delivered because of err
+// to DeadLetter, or returns err if there is none.
+func (wh *Webhook) deadLetter(payload []byte, err error) error {
+	if wh.DeadLetter != nil {
+		wh.DeadLetter(payload, err)
+		return nil
+	}
+	return err
+}
+
+// deliver posts payload to the webhook's URL once.
+func (wh *Webhook) deliver(ctx context.Context, payload []byte) error {
+	if wh.URL == "" {
+		return errors.New("the webhook's URL must not be empty")
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", wh.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.Signer != nil {
+		if err := wh.Signer.SignRequest(req, payload); err != nil {
+			return err
+		}
+	}
+
+	client := wh.Client
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxWebhookDrain))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status code %d: %s", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package gcm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	signer := &HMACSigner{Key: []byte("secret")}
+	var payloads []WebhookPayload
+	failures := 1
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := signer.Sign(r.Header.Get("X-Signature-Timestamp"), r.Method, r.URL.Path, body)
+		if r.Header.Get("X-Signature") != want {
+			t.Errorf("webhook received a request with an invalid signature")
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatalf("failed to decode payload: %s", err)
+		}
+		payloads = append(payloads, payload)
+	}))
+	defer hook.Close()
+
+	webhook := &Webhook{URL: hook.URL + "/results", Signer: signer, Retries: 1, Backoff: time.Millisecond}
+	sender := &Sender{Simulator: new(Simulator), Processors: []ResultProcessor{webhook}}
+	if _, err := sender.SendNoRetry(NewMessage(nil, "1", "2")); err != nil {
+		t.Fatalf("expect to be success: %s", err)
+	}
+	if len(payloads) != 1 || payloads[0].Success != 2 || len(payloads[0].Outcomes) != 2 || payloads[0].Outcomes[1].RegistrationID != "2" {
+		t.Fatalf("payloads %+v, want one delivery with both outcomes", payloads)
+	}
+
+	// Deliveries that fail every attempt go to the dead letter.
+	failures = 2
+	var dead [][]byte
+	webhook.DeadLetter = func(payload []byte, err error) { dead = append(dead, payload) }
+	if _, err := sender.SendNoRetry(NewMessage(nil, "3")); err != nil {
+		t.Fatalf("expect to be success with a dead letter: %s", err)
+	}
+	if len(dead) != 1 || len(payloads) != 1 {
+		t.Fatalf("%d dead letters and %d deliveries, want 1 and 1", len(dead), len(payloads))
+	}
+
+	failures = 2
+	webhook.DeadLetter = nil
+	if _, err := sender.SendNoRetry(NewMessage(nil, "4")); err == nil {
+		t.Fatal("test should fail when the webhook is undeliverable")
+	}
+}
+
+func TestWebhookOutcomesDeadLetter(t *testing.T) {
+	var deliveries int
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deliveries++
+	}))
+	defer hook.Close()
+
+	var dead []error
+	webhook := &Webhook{URL: hook.URL, DeadLetter: func(payload []byte, err error) { dead = append(dead, err) }}
+	resp := &Response{Success: 1, Results: []Result{{MessageID: "id"}}}
+	if err := webhook.Process(context.Background(), []string{"1", "2"}, resp); err != nil {
+		t.Fatalf("expect to be success with a dead letter: %s", err)
+	}
+	if len(dead) != 1 || deliveries != 0 {
+		t.Fatalf("%d dead letters and %d deliveries, want 1 and 0", len(dead), deliveries)
+	}
+
+	webhook.DeadLetter = nil
+	if err := webhook.Process(context.Background(), []string{"1", "2"}, resp); err == nil {
+		t.Fatal("test should fail when the outcomes cannot be determined")
+	}
+}